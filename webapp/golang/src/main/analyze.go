@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type analyzeOptions struct {
+	format string
+	sortBy string
+	limit  int
+}
+
+// durationSummary は秒単位の計測値の集計結果
+type durationSummary struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Avg   float64 `json:"avg"`
+	P50   float64 `json:"p50"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func summarize(vs []float64) durationSummary {
+	s := durationSummary{Count: len(vs)}
+	if len(vs) == 0 {
+		return s
+	}
+	sorted := append([]float64{}, vs...)
+	sort.Float64s(sorted)
+	for _, v := range sorted {
+		s.Sum += v
+	}
+	s.Avg = s.Sum / float64(len(sorted))
+	s.P50 = sorted[percentileIndex(len(sorted), 50)]
+	s.P99 = sorted[percentileIndex(len(sorted), 99)]
+	s.Max = sorted[len(sorted)-1]
+	return s
+}
+
+func (s durationSummary) sortKey(by string) float64 {
+	switch by {
+	case "count":
+		return float64(s.Count)
+	case "avg":
+		return s.Avg
+	case "p50":
+		return s.P50
+	case "p99":
+		return s.P99
+	case "max":
+		return s.Max
+	default:
+		return s.Sum
+	}
+}
+
+type accessLogEntry struct {
+	Method  string          `json:"method"`
+	Route   string          `json:"route"`
+	Status  string          `json:"status"`
+	ReqTime durationSummary `json:"reqtime"`
+	AppTime durationSummary `json:"apptime"`
+	Bytes   int64           `json:"bytes"`
+
+	reqTimes []float64
+	appTimes []float64
+}
+
+func parseLTSV(line string) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range strings.Split(line, "\t") {
+		if i := strings.Index(f, ":"); i > 0 {
+			fields[f[:i]] = f[i+1:]
+		}
+	}
+	return fields
+}
+
+// analyzeAccessLog は conf/nginx.conf の ltsv 形式のアクセスログをルート・ステータスごとに集計する
+func analyzeAccessLog(r io.Reader) ([]*accessLogEntry, error) {
+	entries := make(map[string]*accessLogEntry)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		fields := parseLTSV(sc.Text())
+		uri, ok := fields["uri"]
+		if !ok {
+			continue
+		}
+		method := fields["method"]
+		status := fields["status"]
+		route := normalizeRoute(method, uri)
+
+		key := method + " " + route + " " + status
+		e, ok := entries[key]
+		if !ok {
+			e = &accessLogEntry{Method: method, Route: route, Status: status}
+			entries[key] = e
+		}
+		if v, err := strconv.ParseFloat(fields["reqtime"], 64); err == nil {
+			e.reqTimes = append(e.reqTimes, v)
+		}
+		if v, err := strconv.ParseFloat(fields["apptime"], 64); err == nil {
+			e.appTimes = append(e.appTimes, v)
+		}
+		if v, err := strconv.ParseInt(fields["size"], 10, 64); err == nil {
+			e.Bytes += v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []*accessLogEntry{}
+	for _, e := range entries {
+		e.ReqTime = summarize(e.reqTimes)
+		e.AppTime = summarize(e.appTimes)
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+type slowQueryEntry struct {
+	Query        string          `json:"query"`
+	QueryTime    durationSummary `json:"query_time"`
+	LockTime     float64         `json:"lock_time"`
+	RowsSent     int64           `json:"rows_sent"`
+	RowsExamined int64           `json:"rows_examined"`
+	Example      string          `json:"example"`
+
+	queryTimes []float64
+}
+
+var (
+	slowQueryHeaderRe = regexp.MustCompile(`Query_time:\s*([0-9.]+)\s+Lock_time:\s*([0-9.]+)\s+Rows_sent:\s*(\d+)\s+Rows_examined:\s*(\d+)`)
+	sqlStringRe       = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"`)
+	sqlNumberRe       = regexp.MustCompile(`\b-?\d+(?:\.\d+)?\b`)
+	sqlInListRe       = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlSpaceRe        = regexp.MustCompile(`\s+`)
+)
+
+// normalizeQuery はリテラルをプレースホルダに置き換えて同じ形のクエリをまとめる
+func normalizeQuery(q string) string {
+	q = sqlStringRe.ReplaceAllString(q, "?")
+	q = sqlNumberRe.ReplaceAllString(q, "?")
+	q = sqlInListRe.ReplaceAllString(q, "IN (...)")
+	q = sqlSpaceRe.ReplaceAllString(q, " ")
+	return strings.TrimSuffix(strings.TrimSpace(q), ";")
+}
+
+// analyzeSlowLog は MySQL のスロークエリログを正規化したクエリごとに集計する
+func analyzeSlowLog(r io.Reader) ([]*slowQueryEntry, error) {
+	entries := make(map[string]*slowQueryEntry)
+
+	var (
+		inQuery                bool
+		queryTime, lockTime    float64
+		rowsSent, rowsExamined int64
+		stmt                   []string
+	)
+	flush := func() {
+		if !inQuery || len(stmt) == 0 {
+			inQuery, stmt = false, nil
+			return
+		}
+		raw := strings.Join(stmt, " ")
+		q := normalizeQuery(raw)
+		e, ok := entries[q]
+		if !ok {
+			e = &slowQueryEntry{Query: q, Example: raw}
+			entries[q] = e
+		}
+		e.queryTimes = append(e.queryTimes, queryTime)
+		e.LockTime += lockTime
+		e.RowsSent += rowsSent
+		e.RowsExamined += rowsExamined
+		inQuery, stmt = false, nil
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			if m := slowQueryHeaderRe.FindStringSubmatch(line); m != nil {
+				flush()
+				inQuery = true
+				queryTime, _ = strconv.ParseFloat(m[1], 64)
+				lockTime, _ = strconv.ParseFloat(m[2], 64)
+				rowsSent, _ = strconv.ParseInt(m[3], 10, 64)
+				rowsExamined, _ = strconv.ParseInt(m[4], 10, 64)
+			} else if strings.HasPrefix(line, "# Time:") || strings.HasPrefix(line, "# User@Host:") {
+				flush()
+			}
+			continue
+		}
+		if !inQuery {
+			continue
+		}
+		lower := strings.ToLower(line)
+		if strings.HasPrefix(lower, "set timestamp=") || strings.HasPrefix(lower, "use ") {
+			continue
+		}
+		stmt = append(stmt, strings.TrimSpace(line))
+	}
+	flush()
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []*slowQueryEntry{}
+	for _, e := range entries {
+		e.QueryTime = summarize(e.queryTimes)
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func writeAccessLogReport(w io.Writer, entries []*accessLogEntry, opts analyzeOptions) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		ki, kj := entries[i].ReqTime.sortKey(opts.sortBy), entries[j].ReqTime.sortKey(opts.sortBy)
+		if ki != kj {
+			return ki > kj
+		}
+		return entries[i].Method+entries[i].Route+entries[i].Status < entries[j].Method+entries[j].Route+entries[j].Status
+	})
+	if opts.limit > 0 && len(entries) > opts.limit {
+		entries = entries[:opts.limit]
+	}
+
+	if opts.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "count\tsum\tavg\tp50\tp99\tmax\tapp_avg\tbytes\tstatus\tmethod\troute")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%d\t%s\t%s\t%s\n",
+			e.ReqTime.Count, e.ReqTime.Sum, e.ReqTime.Avg, e.ReqTime.P50, e.ReqTime.P99, e.ReqTime.Max,
+			e.AppTime.Avg, e.Bytes, e.Status, e.Method, e.Route)
+	}
+	return tw.Flush()
+}
+
+func writeSlowLogReport(w io.Writer, entries []*slowQueryEntry, opts analyzeOptions) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		ki, kj := entries[i].QueryTime.sortKey(opts.sortBy), entries[j].QueryTime.sortKey(opts.sortBy)
+		if ki != kj {
+			return ki > kj
+		}
+		return entries[i].Query < entries[j].Query
+	})
+	if opts.limit > 0 && len(entries) > opts.limit {
+		entries = entries[:opts.limit]
+	}
+
+	if opts.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "count\tsum\tavg\tp50\tp99\tmax\trows_sent\trows_examined\tquery")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%d\t%d\t%s\n",
+			e.QueryTime.Count, e.QueryTime.Sum, e.QueryTime.Avg, e.QueryTime.P50, e.QueryTime.P99, e.QueryTime.Max,
+			e.RowsSent, e.RowsExamined, e.Query)
+	}
+	return tw.Flush()
+}
+
+func analyzeUsage() {
+	fmt.Fprintln(os.Stderr, "usage: app analyze access [options] [/var/log/nginx/access.log]")
+	fmt.Fprintln(os.Stderr, "       app analyze slow [options] [/var/log/mysql/mysql-slow.log]")
+	os.Exit(2)
+}
+
+func runAnalyze(args []string) {
+	if len(args) == 0 {
+		analyzeUsage()
+	}
+
+	opts := analyzeOptions{}
+	fs := flag.NewFlagSet("analyze "+args[0], flag.ExitOnError)
+	fs.StringVar(&opts.format, "format", "table", "Output format (table or json)")
+	fs.StringVar(&opts.sortBy, "sort", "sum", "Sort key (count, sum, avg, p50, p99 or max)")
+	fs.IntVar(&opts.limit, "limit", 0, "Show only the top N rows (0 shows all)")
+	fs.Parse(args[1:])
+
+	var defaultPath string
+	switch args[0] {
+	case "access":
+		defaultPath = "/var/log/nginx/access.log"
+	case "slow":
+		defaultPath = "/var/log/mysql/mysql-slow.log"
+	default:
+		analyzeUsage()
+	}
+	p := fs.Arg(0)
+	if p == "" {
+		p = defaultPath
+	}
+
+	var r io.Reader = os.Stdin
+	if p != "-" {
+		f, err := os.Open(p)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %s", p, err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var err error
+	if args[0] == "access" {
+		var entries []*accessLogEntry
+		if entries, err = analyzeAccessLog(r); err == nil {
+			err = writeAccessLogReport(os.Stdout, entries, opts)
+		}
+	} else {
+		var entries []*slowQueryEntry
+		if entries, err = analyzeSlowLog(r); err == nil {
+			err = writeSlowLogReport(os.Stdout, entries, opts)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to analyze %s: %s", p, err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// JSON API で返す投稿。User.Passhash や CSRFToken などを含めないよう Post とは別に定義する
+type apiUser struct {
+	ID          int    `json:"id"`
+	AccountName string `json:"account_name"`
+}
+
+type apiComment struct {
+	ID        int       `json:"id"`
+	User      apiUser   `json:"user"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiPost struct {
+	ID           int          `json:"id"`
+	User         apiUser      `json:"user"`
+	Body         string       `json:"body"`
+	ImageURL     string       `json:"image_url"`
+	CreatedAt    time.Time    `json:"created_at"`
+	CommentCount int          `json:"comment_count"`
+	LikeCount    int          `json:"like_count"`
+	Comments     []apiComment `json:"comments"`
+	Cursor       string       `json:"cursor"`
+}
+
+type apiPostsResponse struct {
+	Posts      []apiPost `json:"posts"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+	// Field は入力の検証に失敗した場合のパラメータ名
+	Field string `json:"field,omitempty"`
+}
+
+func newAPIError(err error) apiError {
+	if verr, ok := err.(*validationError); ok {
+		return apiError{Error: verr.Message, Field: verr.Field}
+	}
+	return apiError{Error: err.Error()}
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{ID: u.ID, AccountName: u.AccountName}
+}
+
+func newAPIPost(p Post) apiPost {
+	comments := make([]apiComment, 0, len(p.Comments))
+	for _, c := range p.Comments {
+		comments = append(comments, apiComment{
+			ID:        c.ID,
+			User:      newAPIUser(c.User),
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+	return apiPost{
+		ID:           p.ID,
+		User:         newAPIUser(p.User),
+		Body:         p.Body,
+		ImageURL:     imageURL(p),
+		CreatedAt:    p.CreatedAt,
+		CommentCount: p.CommentCount,
+		LikeCount:    p.LikeCount,
+		Comments:     comments,
+		Cursor:       p.Cursor(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func getAPIPosts(w http.ResponseWriter, r *http.Request) {
+	pg, perr := parsePostsPage(r)
+	if perr != nil {
+		writeJSON(w, http.StatusBadRequest, newAPIError(perr))
+		return
+	}
+
+	where, args := activeUserPostsCond, []interface{}{}
+	if accountName := r.URL.Query().Get("account_name"); accountName != "" {
+		where += " AND `user_id` = (SELECT `id` FROM `users` WHERE `account_name` = ?)"
+		args = append(args, accountName)
+	}
+
+	results, rerr := selectPostsPage(where, args, pg)
+	if rerr != nil {
+		fmt.Println(rerr)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	posts, merr := makePosts(results, User{}, "", false)
+	if merr != nil {
+		fmt.Println(merr)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	res := apiPostsResponse{Posts: make([]apiPost, 0, len(posts)), NextCursor: nextCursor(results, pg)}
+	for _, p := range posts {
+		res.Posts = append(res.Posts, newAPIPost(p))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
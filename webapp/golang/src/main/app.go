@@ -4,7 +4,6 @@ import (
 	crand "crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -19,7 +18,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -36,13 +35,17 @@ var (
 	memcacheClient *memcache.Client
 	store          *gsm.MemcacheStore
 
-	userMtx    sync.Mutex
-	postMtx    sync.Mutex
-	commentMtx sync.Mutex
-
 	indexTemplate       *template.Template
 	postsTemplate       *template.Template
 	accountNameTemplate *template.Template
+	tagTemplate         *template.Template
+	searchTemplate      *template.Template
+
+	templateFuncs = template.FuncMap{
+		"imageURL":      imageURL,
+		"formatBody":    formatBody,
+		"formatComment": formatComment,
+	}
 )
 
 const (
@@ -72,45 +75,70 @@ type Post struct {
 	Mime         string    `db:"mime"`
 	CreatedAt    time.Time `db:"created_at"`
 	CommentCount int
+	LikeCount    int
 	Comments     []Comment
 	User         User
 	CSRFToken    string
+	// Liked は makePosts に渡した閲覧者がこの投稿にいいねしているか
+	Liked bool
+	// Viewer は投稿の個別ページでコメントの編集・削除ボタンを出すときだけ入れる
+	Viewer      User
+	CanModerate bool
+	// Highlight は検索結果で本文とコメント中の検索語を強調するときだけ入れる
+	Highlight *regexp.Regexp
 }
 
 type Comment struct {
-	ID        int       `db:"id"`
-	PostID    int       `db:"post_id"`
-	UserID    int       `db:"user_id"`
-	Comment   string    `db:"comment"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        int        `db:"id"`
+	PostID    int        `db:"post_id"`
+	UserID    int        `db:"user_id"`
+	Comment   string     `db:"comment"`
+	CreatedAt time.Time  `db:"created_at"`
+	EditedAt  *time.Time `db:"edited_at"`
 	User      User
 }
 
-func init() {
-	memcacheClient = memcache.New("/tmp/memcached.sock")
+func initServer() {
+	memcacheAddress := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
+	if memcacheAddress == "" {
+		memcacheAddress = "/tmp/memcached.sock"
+	}
+	memcacheClient = memcache.New(memcacheAddress)
 	memcacheClient.Timeout = 300 * time.Millisecond
 	memcacheClient.DeleteAll()
+	go watchCacheGenerations(100 * time.Millisecond)
 	store = gsm.NewMemcacheStore(memcacheClient, "isucogram_", []byte("sendagaya"))
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
-	indexTemplate = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	indexTemplate = template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("index.html"),
+		getTemplPath("trending.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
 	))
-	postsTemplate = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
+	postsTemplate = template.Must(template.New("posts.html").Funcs(templateFuncs).ParseFiles(
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
 	))
-	accountNameTemplate = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	accountNameTemplate = template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("user.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
 	))
+	tagTemplate = template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("tag.html"),
+		getTemplPath("trending.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	))
+	searchTemplate = template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("search.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	))
 }
 
 func dbInitialize() {
@@ -140,6 +168,21 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM user_bans",
+		"DELETE FROM reports",
+		"UPDATE posts SET hidden_at = NULL WHERE hidden_at IS NOT NULL",
+		"UPDATE posts SET deleted_at = NULL, image_removed_at = NULL WHERE deleted_at IS NOT NULL",
+		"UPDATE comments SET hidden_at = NULL WHERE hidden_at IS NOT NULL",
+		"UPDATE comments SET deleted_at = NULL WHERE deleted_at IS NOT NULL",
+		"DELETE FROM comment_edits",
+		"DELETE FROM post_tags WHERE post_id > 10000",
+		"DELETE FROM mentions",
+		"DELETE FROM notifications",
+		"DELETE FROM notification_preferences",
+		"DELETE FROM follows",
+		"DELETE FROM timelines",
+		"UPDATE user_counters SET follower_count = 0, following_count = 0",
+		"DELETE FROM user_roles WHERE user_id > 1000",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
 	}
@@ -147,6 +190,16 @@ func dbInitialize() {
 	for _, sql := range sqls {
 		db.Exec(sql)
 	}
+	if err := resetLikes(); err != nil {
+		fmt.Println("error: " + err.Error())
+	}
+	if err := resetBlocks(); err != nil {
+		fmt.Println("error: " + err.Error())
+	}
+
+	if err := resetCounters(); err != nil {
+		fmt.Println("error: " + err.Error())
+	}
 
 	resetCaches()
 }
@@ -173,7 +226,7 @@ func tryLogin(accountName, password string) int {
 }
 
 func validateUser(accountName, password string) bool {
-	if !(regexp.MustCompile("\\A[0-9a-zA-Z_]{3,}\\z").MatchString(accountName) &&
+	if !(accountNameRegexp.MatchString(accountName) &&
 		regexp.MustCompile("\\A[0-9a-zA-Z_]{6,}\\z").MatchString(password)) {
 		return false
 	}
@@ -242,14 +295,22 @@ func getUserCacheKey(uid int) string {
 
 func getUsers(uids []int) (map[int]User, error) {
 	users := make(map[int]User)
+	gen := userCache.generation()
 
 	keys := []string{}
+	remoteUids := []int{}
 	for _, uid := range uids {
-		keys = append(keys, getUserCacheKey(uid))
+		key := getUserCacheKey(uid)
+		if v, ok := userCache.get(key); ok {
+			users[uid] = v.(User)
+			continue
+		}
+		keys = append(keys, key)
+		remoteUids = append(remoteUids, uid)
+	}
+	if len(remoteUids) == 0 {
+		return users, nil
 	}
-
-	userMtx.Lock()
-	defer userMtx.Unlock()
 
 	items, err := memcacheClient.GetMulti(keys)
 	if items == nil && err != nil {
@@ -257,70 +318,139 @@ func getUsers(uids []int) (map[int]User, error) {
 	}
 
 	missUids := []int{}
-	for _, uid := range uids {
+	refresh := map[int]*memcache.Item{}
+	for _, uid := range remoteUids {
 		key := getUserCacheKey(uid)
 		item, ok := items[key]
 		if ok {
-			u := User{}
-			err = json.Unmarshal(item.Value, &u)
-			if err != nil {
-				panic(fmt.Sprintf("error user unmarshal " + err.Error()))
+			v, err := unwrapCacheValue(item.Value)
+			var u User
+			if err == nil {
+				u, err = decodeUser(v.payload)
 			}
-			users[uid] = u
-		} else {
-			missUids = append(missUids, uid)
+			if err == nil {
+				users[uid] = u
+				userCache.set(key, u, gen)
+				if v.shouldRefreshEarly() {
+					refresh[uid] = item
+				}
+				continue
+			}
+			// 古い形式の値は消して DB から読み直す
+			memcacheClient.Delete(key)
 		}
+		missUids = append(missUids, uid)
+	}
+	userCache.countRemote(len(remoteUids)-len(missUids), len(missUids))
+	if len(refresh) > 0 {
+		go refreshItems("user", userCachePolicy, refresh, func(ids []int) (map[int][]byte, error) {
+			users, err := queryUsers(ids)
+			if err != nil {
+				return nil, err
+			}
+			payloads := make(map[int][]byte, len(users))
+			for _, u := range users {
+				payloads[u.ID] = encodeUser(u)
+			}
+			return payloads, nil
+		})
 	}
 
 	if len(missUids) > 0 {
-		q, vs, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", missUids)
+		v, err := cacheLoadGroup.Do(flightKey("users:", missUids), func() (interface{}, error) {
+			return loadUsers(missUids)
+		})
 		if err != nil {
-			panic("sqlx.In " + err.Error())
+			return nil, err
 		}
-		missUsers := []User{}
-		err = db.Select(&missUsers, q, vs...)
-		for _, u := range missUsers {
+		for _, u := range v.([]User) {
 			users[u.ID] = u
-			key := getUserCacheKey(u.ID)
-			userMarshaled, err := json.Marshal(&u)
-			if err != nil {
-				panic("userMarshaled: " + err.Error())
-			}
-			memcacheClient.Set(&memcache.Item{Key: key, Value: userMarshaled})
+			userCache.set(getUserCacheKey(u.ID), u, gen)
 		}
 	}
 
 	return users, nil
 }
 
-func banUserOnCache(userID int) {
-	u := User{}
-	key := getUserCacheKey(userID)
-
-	userMtx.Lock()
-	defer userMtx.Unlock()
+// queryUsers はキャッシュを通さずに DB からユーザーを読み込む。Passhash は空にして返す
+func queryUsers(uids []int) ([]User, error) {
+	q, vs, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", uids)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = db.Select(&users, q, vs...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Passhash = ""
+	}
+	return users, nil
+}
 
-	item, err := memcacheClient.Get(key)
+// loadUsers は DB からユーザーを読み込んでキャッシュに入れる。
+// 読み込み中に setUserDelFlgOnCache などで更新された値を上書きしないよう Set ではなく Add を使う
+func loadUsers(uids []int) ([]User, error) {
+	start := time.Now()
+	users, err := queryUsers(uids)
 	if err != nil {
-		return
+		return nil, err
+	}
+	delta := time.Since(start)
+	for _, u := range users {
+		memcacheClient.Add(userCachePolicy.item(getUserCacheKey(u.ID), encodeUser(u), delta))
+	}
+	return users, nil
+}
+
+// setUserDelFlgOnCache は BAN や BAN 解除をキャッシュ上のユーザーに反映する
+func setUserDelFlgOnCache(userID int, delFlg int) {
+	load := func() ([]byte, error) {
+		u := User{}
+		err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", userID)
+		if err != nil {
+			return nil, err
+		}
+		return encodeUser(u), nil
 	}
-	err = json.Unmarshal(item.Value, &u)
+	err := casUpdate(getUserCacheKey(userID), userCachePolicy, load, func(value []byte) ([]byte, error) {
+		u, err := decodeUser(value)
+		if err != nil {
+			return nil, err
+		}
+		if u.DelFlg == delFlg {
+			return nil, nil
+		}
+		u.DelFlg = delFlg
+		return encodeUser(u), nil
+	})
 	if err != nil {
-		panic(fmt.Sprintf("error user unmarshal (ID: %d): %s\n", userID, err.Error()))
+		fmt.Printf("error set del_flg on cache (ID: %d): %s\n", userID, err.Error())
 	}
-	u.DelFlg = 1
-	userMarshaled, err := json.Marshal(&u)
+	userCache.invalidate()
+}
+
+// reloadUserOnCache はキャッシュ上のユーザーを DB の値で置き換える
+func reloadUserOnCache(userID int) {
+	err := casReplace(getUserCacheKey(userID), userCachePolicy, func() ([]byte, error) {
+		users, err := queryUsers([]int{userID})
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("user not found (ID: %d)", userID)
+		}
+		return encodeUser(users[0]), nil
+	})
 	if err != nil {
-		panic(fmt.Sprintf("error user marshal (ID: %d): %s\n", userID, err.Error()))
-		return
+		fmt.Printf("error reload user on cache (ID: %d): %s\n", userID, err.Error())
 	}
-	memcacheClient.Set(&memcache.Item{Key: key, Value: userMarshaled})
+	userCache.invalidate()
 }
 
 func appendUser(accountName string, passhash string) (int, error) {
 	u := User{AccountName: accountName, Passhash: passhash, Authority: 0, DelFlg: 0, CreatedAt: time.Now()}
-	userMtx.Lock()
-	defer userMtx.Unlock()
 	result, err := db.Exec("INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", u.AccountName, u.Passhash)
 	if err != nil {
 		return -1, err
@@ -330,14 +460,15 @@ func appendUser(accountName string, passhash string) (int, error) {
 		return -1, err
 	}
 	u.ID = int(uid)
-	userMarshaled, err := json.Marshal(&u)
-	if err != nil {
-		return -1, err
-	}
-	memcacheClient.Set(&memcache.Item{Key: getUserCacheKey(u.ID), Value: userMarshaled})
+	publishInvalidation(userRegistered{User: u})
 	return u.ID, nil
 }
 
+func setUserOnCache(u User) {
+	u.Passhash = ""
+	memcacheClient.Set(userCachePolicy.item(getUserCacheKey(u.ID), encodeUser(u), 0))
+}
+
 func resetUserCache() {
 	users := []User{}
 	err := db.Select(&users, "SELECT * FROM `users`")
@@ -345,41 +476,149 @@ func resetUserCache() {
 		panic("error with SELECT * FROM `users`: " + err.Error())
 	}
 	for _, u := range users {
-		key := getUserCacheKey(u.ID)
-		userMarshaled, err := json.Marshal(&u)
-		if err != nil {
-			panic("userMarshaled: " + err.Error())
-		}
-		memcacheClient.Set(&memcache.Item{Key: key, Value: userMarshaled})
+		memcacheClient.Set(userCachePolicy.item(getUserCacheKey(u.ID), encodeUser(u), 0))
 	}
+	userCache.invalidate()
 }
 
+// BAN されていないユーザーの投稿に絞る条件
+const activeUserPostsCond = "`user_id` IN (SELECT `id` FROM `users` WHERE `del_flg` = 0)"
+
 func getIndexPostsCacheKey() string {
 	return "indexPosts"
 }
 
+// getIndexPosts はトップページの投稿一覧を返す。
+// memcache の値は期限を過ぎても消えず、期限切れの値を返しつつ refreshIndexPosts で作り直す
 func getIndexPosts() ([]Post, error) {
-	posts := []Post{}
 	key := getIndexPostsCacheKey()
-	postMtx.Lock()
-	defer postMtx.Unlock()
+	gen := indexPostsCache.generation()
+	if v, ok := indexPostsCache.get(key); ok {
+		return v.([]Post), nil
+	}
 	item, err := memcacheClient.Get(key)
 	if err == nil {
-		err = json.Unmarshal(item.Value, &posts)
+		v, err := unwrapCacheValue(item.Value)
+		var posts []Post
+		if err == nil {
+			posts, err = decodePosts(v.payload)
+		}
+		if err == nil {
+			indexPostsCache.countRemote(1, 0)
+			if v.stale() {
+				cacheStats.Add("indexPosts.stale", 1)
+				go refreshIndexPosts()
+				return posts, nil
+			}
+			if v.shouldRefreshEarly() {
+				go refreshIndexPosts()
+			}
+			indexPostsCache.set(key, posts, gen)
+			return posts, nil
+		}
+		memcacheClient.Delete(key)
+	}
+	indexPostsCache.countRemote(0, 1)
+	v, err := cacheLoadGroup.Do(key, func() (interface{}, error) {
+		start := time.Now()
+		posts, err := queryIndexPosts()
 		if err != nil {
-			panic(fmt.Sprintf("error indexPosts unmarshal: %s\n", err.Error()))
+			return nil, err
 		}
+		memcacheClient.Add(indexPostsCachePolicy.item(key, encodePosts(posts), time.Since(start)))
 		return posts, nil
-	}
-	err = db.Select(&posts, "SELECT `posts`.`id`, `user_id`, `body`, `mime`, `posts`.`created_at` FROM `posts` WHERE `user_id` IN (SELECT `id` FROM `users` WHERE `del_flg` = 0) ORDER BY `created_at` DESC LIMIT ?", postsPerPage)
+	})
 	if err != nil {
 		return nil, err
 	}
-	postsMarshaled, err := json.Marshal(&posts)
-	if err == nil {
-		memcacheClient.Set(&memcache.Item{Key: key, Value: postsMarshaled})
+	indexPostsCache.set(key, v.([]Post), gen)
+	return v.([]Post), nil
+}
+
+func queryIndexPosts() ([]Post, error) {
+	return selectPostsPage(activeUserPostsCond, nil, postsPage{Limit: postsPerPage})
+}
+
+// indexPostsRefreshing はこのプロセスで refreshIndexPosts が動いている間 1 になる
+var indexPostsRefreshing int32
+
+// refreshIndexPosts は期限切れのトップページの投稿一覧を作り直す。
+// プロセス内ではフラグで、プロセス間では memcache のロックで同時に1つだけ動くようにする
+func refreshIndexPosts() {
+	if !atomic.CompareAndSwapInt32(&indexPostsRefreshing, 0, 1) {
+		return
 	}
-	return posts, nil
+	defer atomic.StoreInt32(&indexPostsRefreshing, 0)
+
+	lockKey := "lock:" + getIndexPostsCacheKey()
+	if err := memcacheClient.Add(&memcache.Item{Key: lockKey, Value: []byte("1"), Expiration: 10}); err != nil {
+		return
+	}
+	defer memcacheClient.Delete(lockKey)
+
+	rebuildIndexPosts()
+}
+
+// rebuildIndexPosts はトップページの投稿一覧を DB から作り直す。
+// BAN のように古い一覧を返してはいけない場合は、ロックを取らずにこれを直接呼ぶ
+func rebuildIndexPosts() {
+	err := casReplace(getIndexPostsCacheKey(), indexPostsCachePolicy, func() ([]byte, error) {
+		posts, err := queryIndexPosts()
+		if err != nil {
+			return nil, err
+		}
+		return encodePosts(posts), nil
+	})
+	if err != nil {
+		fmt.Printf("error rebuilding index posts: %s\n", err.Error())
+	}
+	indexPostsCache.invalidate()
+}
+
+// prependIndexPost は新しい投稿をキャッシュ済みのトップページの投稿一覧の先頭に追加する。
+// キャッシュが無い場合は次の読み込みで DB から作られるので何もしない
+func prependIndexPost(p Post) {
+	err := casUpdate(getIndexPostsCacheKey(), indexPostsCachePolicy, nil, func(value []byte) ([]byte, error) {
+		posts, err := decodePosts(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, pp := range posts {
+			if pp.ID == p.ID {
+				return nil, nil
+			}
+		}
+		posts = append([]Post{p}, posts...)
+		if len(posts) > postsPerPage {
+			posts = posts[:postsPerPage]
+		}
+		return encodePosts(posts), nil
+	})
+	if err != nil {
+		fmt.Printf("error prepending index post (ID: %d): %s\n", p.ID, err.Error())
+	}
+	indexPostsCache.invalidate()
+}
+
+// updateIndexPost はキャッシュ済みのトップページの投稿一覧に p があれば本文を置き換える
+func updateIndexPost(p Post) {
+	err := casUpdate(getIndexPostsCacheKey(), indexPostsCachePolicy, nil, func(value []byte) ([]byte, error) {
+		posts, err := decodePosts(value)
+		if err != nil {
+			return nil, err
+		}
+		for i := range posts {
+			if posts[i].ID == p.ID {
+				posts[i].Body = p.Body
+				return encodePosts(posts), nil
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		fmt.Printf("error updating index post (ID: %d): %s\n", p.ID, err.Error())
+	}
+	indexPostsCache.invalidate()
 }
 
 func getCommentsCacheKey(pid int) string {
@@ -387,104 +626,317 @@ func getCommentsCacheKey(pid int) string {
 }
 
 func getComments(pid int) ([]Comment, error) {
-	comments := []Comment{}
-	key := getCommentsCacheKey(pid)
+	commentsByPost, err := getCommentsMulti([]int{pid})
+	if err != nil {
+		return nil, err
+	}
+	return commentsByPost[pid], nil
+}
 
-	commentMtx.Lock()
-	defer commentMtx.Unlock()
-	item, err := memcacheClient.Get(key)
-	if err == nil {
-		err = json.Unmarshal(item.Value, &comments)
+// getCommentsMulti は複数の投稿のコメントを GetMulti 1回と、キャッシュに無かった分の IN クエリ1回で取得する
+func getCommentsMulti(pids []int) (map[int][]Comment, error) {
+	commentsByPost := make(map[int][]Comment, len(pids))
+	if len(pids) == 0 {
+		return commentsByPost, nil
+	}
+	gen := commentCache.generation()
+
+	// プロセス内キャッシュの値は共有されているので、呼び出し元が書き換えてもいいようにコピーして返す
+	keys := make([]string, 0, len(pids))
+	remotePids := []int{}
+	for _, pid := range pids {
+		key := getCommentsCacheKey(pid)
+		if v, ok := commentCache.get(key); ok {
+			commentsByPost[pid] = append([]Comment{}, v.([]Comment)...)
+			continue
+		}
+		keys = append(keys, key)
+		remotePids = append(remotePids, pid)
+	}
+	if len(remotePids) == 0 {
+		return commentsByPost, nil
+	}
+
+	items, err := memcacheClient.GetMulti(keys)
+	if items == nil && err != nil {
+		fmt.Printf("error reading comments from %s\n", err.Error())
+	}
+
+	missPids := []int{}
+	refresh := map[int]*memcache.Item{}
+	for _, pid := range remotePids {
+		if _, ok := commentsByPost[pid]; ok {
+			continue
+		}
+		key := getCommentsCacheKey(pid)
+		item, ok := items[key]
+		if !ok {
+			missPids = append(missPids, pid)
+			continue
+		}
+		v, err := unwrapCacheValue(item.Value)
+		var comments []Comment
+		if err == nil {
+			comments, err = decodeComments(v.payload)
+		}
 		if err != nil {
-			panic(fmt.Sprintf("error comments unmarshal (ID: %d): %s\n", pid, err.Error()))
+			// 古い形式の値は消して DB から読み直す
+			memcacheClient.Delete(key)
+			missPids = append(missPids, pid)
+			continue
+		}
+		if v.shouldRefreshEarly() {
+			refresh[pid] = item
 		}
-		return comments, nil
+		commentCache.set(key, comments, gen)
+		commentsByPost[pid] = append([]Comment{}, comments...)
+	}
+	commentCache.countRemote(len(remotePids)-len(missPids), len(missPids))
+	if len(refresh) > 0 {
+		go refreshItems("comments", commentCachePolicy, refresh, func(ids []int) (map[int][]byte, error) {
+			commentsByPost, err := queryComments(ids)
+			if err != nil {
+				return nil, err
+			}
+			payloads := make(map[int][]byte, len(commentsByPost))
+			for pid, comments := range commentsByPost {
+				payloads[pid] = encodeComments(comments)
+			}
+			return payloads, nil
+		})
 	}
-	// fmt.Printf("error reading comments (ID: %d) from %s\n", pid, err.Error())
 
-	err = db.Select(&comments, "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at`", pid)
+	if len(missPids) > 0 {
+		v, err := cacheLoadGroup.Do(flightKey("comments:", missPids), func() (interface{}, error) {
+			return loadComments(missPids)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for pid, comments := range v.(map[int][]Comment) {
+			commentCache.set(getCommentsCacheKey(pid), comments, gen)
+			commentsByPost[pid] = append([]Comment{}, comments...)
+		}
+	}
+
+	return commentsByPost, nil
+}
+
+// queryComments はキャッシュを通さずに DB から投稿ごとのコメントを読み込む。コメントの無い投稿は空スライスになる
+func queryComments(pids []int) (map[int][]Comment, error) {
+	q, vs, err := sqlx.In("SELECT `id`, `post_id`, `user_id`, `comment`, `created_at`, `edited_at` FROM `comments` WHERE `post_id` IN (?) AND `hidden_at` IS NULL AND `deleted_at` IS NULL ORDER BY `created_at`, `id`", pids)
+	if err != nil {
+		return nil, err
+	}
+	comments := []Comment{}
+	err = db.Select(&comments, q, vs...)
 	if err != nil {
 		return nil, err
 	}
 
-	commentsMarshaled, err := json.Marshal(&comments)
-	if err == nil {
-		memcacheClient.Set(&memcache.Item{Key: key, Value: commentsMarshaled})
+	commentsByPost := make(map[int][]Comment, len(pids))
+	for _, pid := range pids {
+		commentsByPost[pid] = []Comment{}
 	}
+	for _, c := range comments {
+		commentsByPost[c.PostID] = append(commentsByPost[c.PostID], c)
+	}
+	return commentsByPost, nil
+}
 
-	return comments, nil
+// loadComments は DB からコメントを読み込んでキャッシュに入れる。
+// 読み込み中に appendComment で追加されたコメントを上書きしないよう Set ではなく Add を使う
+func loadComments(pids []int) (map[int][]Comment, error) {
+	start := time.Now()
+	commentsByPost, err := queryComments(pids)
+	if err != nil {
+		return nil, err
+	}
+	delta := time.Since(start)
+	for pid, comments := range commentsByPost {
+		memcacheClient.Add(commentCachePolicy.item(getCommentsCacheKey(pid), encodeComments(comments), delta))
+	}
+	return commentsByPost, nil
 }
 
 func appendComment(postID int, user *User, comment string) error {
 	c := Comment{PostID: postID, UserID: user.ID, Comment: comment, CreatedAt: time.Now(), User: *user}
-	key := getCommentsCacheKey(postID)
-	comments := []Comment{}
 
-	commentMtx.Lock()
-	defer commentMtx.Unlock()
-	result, err := db.Exec("INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)", c.PostID, c.UserID, c.Comment)
+	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
-	item, err := memcacheClient.Get(key)
-	if err != nil {
-		return nil
-	}
-	err = json.Unmarshal(item.Value, &comments)
+	result, err := tx.Exec("INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)", c.PostID, c.UserID, c.Comment)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	cid, err := result.LastInsertId()
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	c.ID = int(cid)
-	comments = append(comments, c)
-	commentsMarshaled, err := json.Marshal(&comments)
+	if err = addCommentCounters(tx, c.UserID, c.PostID, 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	ns, err := setMentions(tx, mentionSource{mentionSourceComment, c.ID, c.PostID, c.UserID}, c.Comment)
 	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
 		return err
 	}
-	memcacheClient.Set(&memcache.Item{Key: key, Value: commentsMarshaled})
+
+	publishInvalidation(commentCreated{Comment: c})
+	enqueueNotifications(append(ns, notification{Type: notificationComment, ActorID: c.UserID, PostID: c.PostID, CommentID: c.ID})...)
 	return nil
 }
 
+// reloadCommentsOnCache はキャッシュ上の postID の投稿のコメントを DB の値で置き換える
+func reloadCommentsOnCache(postID int) {
+	err := casReplace(getCommentsCacheKey(postID), commentCachePolicy, func() ([]byte, error) {
+		commentsByPost, err := queryComments([]int{postID})
+		if err != nil {
+			return nil, err
+		}
+		return encodeComments(commentsByPost[postID]), nil
+	})
+	if err != nil {
+		fmt.Printf("error reload comments on cache (post ID: %d): %s\n", postID, err.Error())
+	}
+	commentCache.evict(getCommentsCacheKey(postID))
+}
+
+func appendCommentOnCache(c Comment) error {
+	postID := c.PostID
+	load := func() ([]byte, error) {
+		commentsByPost, err := queryComments([]int{postID})
+		if err != nil {
+			return nil, err
+		}
+		return encodeComments(commentsByPost[postID]), nil
+	}
+	defer commentCache.evict(getCommentsCacheKey(postID))
+	return casUpdate(getCommentsCacheKey(postID), commentCachePolicy, load, func(value []byte) ([]byte, error) {
+		comments, err := decodeComments(value)
+		if err != nil {
+			return nil, err
+		}
+		// DB から読み込み直した値に既に含まれている場合は何もしない
+		for _, cc := range comments {
+			if cc.ID == c.ID {
+				return nil, nil
+			}
+		}
+		comments = append(comments, c)
+		return encodeComments(comments), nil
+	})
+}
+
 func resetCommentCache() {
 	postIDs := []int{}
 	err := db.Select(&postIDs, "SELECT id FROM `posts`")
 	if err != nil {
 		panic("error with SELECT id FROM `posts`: " + err.Error())
 	}
-	for _, postID := range postIDs {
-		getComments(postID)
+	const chunkSize = 1000
+	for i := 0; i < len(postIDs); i += chunkSize {
+		end := i + chunkSize
+		if end > len(postIDs) {
+			end = len(postIDs)
+		}
+		getCommentsMulti(postIDs[i:end])
 	}
+	commentCache.invalidate()
 }
 
-func makePosts(results []Post, CSRFToken string, allComments bool) ([]Post, error) {
+func makePosts(results []Post, viewer User, CSRFToken string, allComments bool) ([]Post, error) {
 	var posts []Post
 
+	// 閲覧者をブロックしているユーザーと、閲覧者がミュート・ブロックしているユーザーの投稿は除く。
+	// 個別ページ (allComments) ではミュート・ブロックしているユーザーの投稿でも出す
+	filter, err := getUserFilter(viewer.ID)
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]Post, 0, len(results))
 	for _, p := range results {
-		comments, err := getComments(p.ID)
-		if err != nil {
-			return nil, err
+		if filter.BlockedBy[p.UserID] || (!allComments && filter.hides(p.UserID)) {
+			continue
 		}
+		visible = append(visible, p)
+	}
+	results = visible
 
-		p.CommentCount = len(comments)
-		if !allComments && p.CommentCount > 3 {
-			comments = comments[:3]
-		}
+	pids := make([]int, 0, len(results))
+	for _, p := range results {
+		pids = append(pids, p.ID)
+	}
+	commentCounts, err := getPostCommentCounts(pids)
+	if err != nil {
+		return nil, err
+	}
+	likeCounts, err := getPostLikeCounts(pids)
+	if err != nil {
+		return nil, err
+	}
+	liked, err := getLikedPostIDs(viewer.ID, pids)
+	if err != nil {
+		return nil, err
+	}
 
-		uids := []int{p.UserID}
-		for i := 0; i < len(comments); i++ {
-			uids = append(uids, comments[i].UserID)
+	commentsByPost, err := getCommentsMulti(pids)
+	if err != nil {
+		return nil, err
+	}
+
+	// 投稿者とコメント投稿者をまとめて1回の getUsers で引く
+	uids := []int{}
+	seen := make(map[int]bool)
+	addUID := func(uid int) {
+		if !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
 		}
-		users, err := getUsers(uids)
-		if err != nil {
-			return nil, err
+	}
+	for _, p := range results {
+		addUID(p.UserID)
+		comments := commentsByPost[p.ID]
+		if len(filter.Muted) > 0 || len(filter.Blocked) > 0 {
+			// キャッシュの値を書き換えないよう新しいスライスに入れる
+			shown := make([]Comment, 0, len(comments))
+			for _, c := range comments {
+				if !filter.hides(c.UserID) {
+					shown = append(shown, c)
+				}
+			}
+			comments = shown
+		}
+		if !allComments && len(comments) > 3 {
+			comments = comments[:3]
+		}
+		for _, c := range comments {
+			addUID(c.UserID)
 		}
+		commentsByPost[p.ID] = comments
+	}
+	users, err := getUsers(uids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range results {
+		comments := commentsByPost[p.ID]
 		for i := 0; i < len(comments); i++ {
 			comments[i].User, _ = users[comments[i].UserID]
 		}
 
+		p.CommentCount = commentCounts[p.ID]
+		p.LikeCount = likeCounts[p.ID]
+		p.Liked = liked[p.ID]
 		p.Comments = comments
 		p.User, _ = users[p.UserID]
 		p.CSRFToken = CSRFToken
@@ -492,9 +944,6 @@ func makePosts(results []Post, CSRFToken string, allComments bool) ([]Post, erro
 		if p.User.DelFlg == 0 {
 			posts = append(posts, p)
 		}
-		if len(posts) >= postsPerPage {
-			break
-		}
 	}
 
 	return posts, nil
@@ -538,8 +987,12 @@ func getTemplPath(filename string) string {
 	return path.Join("templates", filename)
 }
 
-func getInitialize(w http.ResponseWriter, r *http.Request) {
+func getInitialize(c web.C, w http.ResponseWriter, r *http.Request) {
 	dbInitialize()
+	// 初期化は監査ログを消さず、初期化したこと自体を記録する
+	if err := appendAuditLogTx(newAuditActor(c, r, getSessionUser(r)), auditActionInitialize, "system", 0, nil, nil); err != nil {
+		fmt.Println(err.Error())
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -655,27 +1108,72 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 func getIndex(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
 
-	results, err := getIndexPosts()
+	pg, perr := parsePostsPage(r)
+	if perr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// ログインしていれば tab=home でフォローしているユーザーの投稿だけを出す
+	tab := ""
+	if isLogin(me) && r.URL.Query().Get("tab") == indexTabHome {
+		tab = indexTabHome
+	}
+
+	var results []Post
+	var err error
+	switch {
+	case tab == indexTabHome:
+		results, err = selectHomeTimeline(me.ID, pg)
+	case pg.IsFirst():
+		results, err = getIndexPosts()
+	default:
+		results, err = selectPostsPage(activeUserPostsCond, nil, pg)
+	}
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), false)
+	posts, merr := makePosts(results, me, getCSRFToken(r), false)
 	if merr != nil {
 		fmt.Println(merr)
 		return
 	}
 
+	trending, terr := getTrendingTags()
+	if terr != nil {
+		fmt.Println(terr)
+		return
+	}
+
 	indexTemplate.Execute(w, struct {
-		Posts     []Post
-		Me        User
-		CSRFToken string
-		Flash     string
-	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+		Posts      []Post
+		Tab        string
+		NextCursor string
+		Me         User
+		CSRFToken  string
+		Flash      string
+		Trending   []tagCount
+	}{posts, tab, nextCursor(results, pg), me, getCSRFToken(r), getFlash(w, r, "notice"), trending})
 }
 
+// ユーザーページのタブ。クエリパラメータ tab で切り替える
+const (
+	accountTabPosts     = "posts"
+	accountTabCommented = "commented"
+)
+
 func getAccountName(c web.C, w http.ResponseWriter, r *http.Request) {
+	renderAccountPage(c, w, r, false)
+}
+
+// getAccountNamePosts は無限スクロールからの XHR には posts.html の断片を、それ以外にはページ全体を返す
+func getAccountNamePosts(c web.C, w http.ResponseWriter, r *http.Request) {
+	renderAccountPage(c, w, r, r.Header.Get("X-Requested-With") == "XMLHttpRequest")
+}
+
+func renderAccountPage(c web.C, w http.ResponseWriter, r *http.Request, fragment bool) {
 	user := User{}
 	uerr := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", c.URLParams["accountName"])
 
@@ -689,98 +1187,131 @@ func getAccountName(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := []Post{}
-	postMtx.Lock()
-	rerr := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, postsPerPage)
-	postMtx.Unlock()
+	pg, pgerr := parsePostsPage(r)
+	if pgerr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tab := r.URL.Query().Get("tab")
+	if tab == "" {
+		tab = accountTabPosts
+	}
+	var where string
+	switch tab {
+	case accountTabPosts:
+		where = "`user_id` = ?"
+	case accountTabCommented:
+		where = "`id` IN (SELECT `post_id` FROM `comments` WHERE `user_id` = ? AND `hidden_at` IS NULL AND `deleted_at` IS NULL)"
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	results, rerr := selectPostsPage(where, []interface{}{user.ID}, pg)
 	if rerr != nil {
 		fmt.Println(rerr)
 		return
 	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), false)
+	me := getSessionUser(r)
+	posts, merr := makePosts(results, me, getCSRFToken(r), false)
 	if merr != nil {
 		fmt.Println(merr)
 		return
 	}
 
-	commentCount := 0
-	cerr := db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
-	if cerr != nil {
-		fmt.Println(cerr)
+	if fragment {
+		if len(posts) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		postsTemplate.Execute(w, posts)
 		return
 	}
 
-	postIDs := []int{}
-	postMtx.Lock()
-	perr := db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
-	postMtx.Unlock()
-	if perr != nil {
-		fmt.Println(perr)
+	stats, serr := getUserCounter(user.ID)
+	if serr != nil {
+		fmt.Println(serr)
 		return
 	}
-	postCount := len(postIDs)
 
-	commentedCount := 0
-	if postCount > 0 {
-		s := []string{}
-		for range postIDs {
-			s = append(s, "?")
-		}
-		placeholder := strings.Join(s, ", ")
-
-		// convert []int -> []interface{}
-		args := make([]interface{}, len(postIDs))
-		for i, v := range postIDs {
-			args[i] = v
+	tabURL := "/@" + user.AccountName + "/posts"
+	if tab != accountTabPosts {
+		tabURL += "?tab=" + tab
+	}
+	nextURL := ""
+	if next := nextCursor(results, pg); next != "" {
+		q := url.Values{"cursor": {next}}
+		if tab != accountTabPosts {
+			q.Set("tab", tab)
 		}
+		nextURL = "/@" + user.AccountName + "/posts?" + q.Encode()
+	}
 
-		ccerr := db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
-		if ccerr != nil {
-			fmt.Println(ccerr)
+	following := false
+	if isLogin(me) && me.ID != user.ID {
+		var ferr error
+		if following, ferr = isFollowing(me.ID, user.ID); ferr != nil {
+			fmt.Println(ferr)
 			return
 		}
 	}
+	filter, ferr := getUserFilter(me.ID)
+	if ferr != nil {
+		fmt.Println(ferr)
+		return
+	}
 
-	me := getSessionUser(r)
 	accountNameTemplate.Execute(w, struct {
 		Posts          []Post
+		Tab            string
+		TabURL         string
+		NextURL        string
 		User           User
 		PostCount      int
 		CommentCount   int
 		CommentedCount int
+		FollowerCount  int
+		FollowingCount int
+		Following      bool
+		Blocking       bool
+		Muting         bool
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+		CSRFToken      string
+		Flash          string
+	}{posts, tab, tabURL, nextURL, user, stats.PostCount, stats.CommentCount, stats.CommentedCount,
+		stats.FollowerCount, stats.FollowingCount, following, filter.Blocked[user.ID], filter.Muted[user.ID],
+		me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
 func getPosts(w http.ResponseWriter, r *http.Request) {
-	m, parseErr := url.ParseQuery(r.URL.RawQuery)
-	if parseErr != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Println(parseErr)
-		return
-	}
-	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
+	q := r.URL.Query()
+	if q.Get("cursor") == "" && q.Get("max_created_at") == "" {
 		return
 	}
 
-	t, terr := time.Parse(ISO8601_FORMAT, maxCreatedAt)
-	if terr != nil {
-		fmt.Println(terr)
+	pg, perr := parsePostsPage(r)
+	if perr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Println(perr)
 		return
 	}
 
-	results := []Post{}
-	postMtx.Lock()
-	rerr := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` IN (SELECT `id` FROM `users` WHERE `del_flg` = 0) AND `created_at` <= ? ORDER BY `created_at` DESC LIMIT ?", t.Format(ISO8601_FORMAT), postsPerPage)
-	postMtx.Unlock()
+	me := getSessionUser(r)
+	var results []Post
+	var rerr error
+	if isLogin(me) && q.Get("tab") == indexTabHome {
+		results, rerr = selectHomeTimeline(me.ID, pg)
+	} else {
+		results, rerr = selectPostsPage(activeUserPostsCond, nil, pg)
+	}
 	if rerr != nil {
 		fmt.Println(rerr)
 		return
 	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), false)
+	posts, merr := makePosts(results, me, getCSRFToken(r), false)
 	if merr != nil {
 		fmt.Println(merr)
 		return
@@ -802,15 +1333,37 @@ func getPostsID(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	results := []Post{}
-	postMtx.Lock()
-	rerr := db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
-	postMtx.Unlock()
+	rerr := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `id` = ? AND `hidden_at` IS NULL AND `deleted_at` IS NULL", pid)
 	if rerr != nil {
 		fmt.Println(rerr)
 		return
 	}
+	if len(results) == 0 {
+		deleted, err := isDeletedPost(pid)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if deleted {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+	}
+
+	me := getSessionUser(r)
+	if len(results) > 0 {
+		filter, err := getUserFilter(me.ID)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if filter.BlockedBy[results[0].UserID] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), true)
+	posts, merr := makePosts(results, me, getCSRFToken(r), true)
 	if merr != nil {
 		fmt.Println(merr)
 		return
@@ -823,20 +1376,31 @@ func getPostsID(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	p := posts[0]
 
-	me := getSessionUser(r)
+	if isLogin(me) {
+		p.Viewer = me
+		p.CanModerate, err = hasPermission(me, permDeleteContent)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	likers, err := getPostLikers(p.ID)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("post_id.html"),
 		getTemplPath("post.html"),
 	)).Execute(w, struct {
-		Post Post
-		Me   User
-	}{p, me})
+		Post   Post
+		Likers []User
+		Me     User
+		Flash  string
+	}{p, likers, me, getFlash(w, r, "notice")})
 }
 
 func postIndex(w http.ResponseWriter, r *http.Request) {
@@ -851,6 +1415,16 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateAuthor(me); err != nil {
+		redirectWithNotice(w, r, "/", err.Error())
+		return
+	}
+	body, verr := validatePostBody(r.FormValue("body"))
+	if verr != nil {
+		redirectWithNotice(w, r, "/", verr.Error())
+		return
+	}
+
 	file, header, ferr := r.FormFile("file")
 	if ferr != nil {
 		session := getSession(r)
@@ -917,27 +1491,57 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 	tempFileName := tempFile.Name()
 	tempFile.Close()
 
-	postMtx.Lock()
-	defer postMtx.Unlock()
-
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
-	result, eerr := db.Exec(
+	tx, err := db.Beginx()
+	if err != nil {
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `fanned_out`) VALUES (?,?,?,?,0)"
+	result, eerr := tx.Exec(
 		query,
 		me.ID,
 		mime,
 		"",
-		r.FormValue("body"),
+		body,
 	)
 	if eerr != nil {
+		tx.Rollback()
 		fmt.Println("error: " + eerr.Error())
 		return
 	}
 
 	pid, lerr := result.LastInsertId()
 	if lerr != nil {
+		tx.Rollback()
 		fmt.Println("error: " + lerr.Error())
 		return
 	}
+	post := Post{ID: int(pid), UserID: me.ID, Body: body, Mime: mime}
+	if err = tx.Get(&post.CreatedAt, "SELECT `created_at` FROM `posts` WHERE `id` = ?", pid); err != nil {
+		tx.Rollback()
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	if err = setPostTags(tx, int(pid), body, post.CreatedAt); err != nil {
+		tx.Rollback()
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	mentions, err := setMentions(tx, mentionSource{mentionSourcePost, post.ID, post.ID, me.ID}, body)
+	if err != nil {
+		tx.Rollback()
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	if err = incrPostCounters(tx, me.ID, int(pid)); err != nil {
+		tx.Rollback()
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		fmt.Println("error: " + err.Error())
+		return
+	}
 
 	if err = os.Chmod(tempFileName, 0666); err != nil {
 		fmt.Println("error: " + err.Error())
@@ -948,7 +1552,12 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	memcacheClient.Delete(getIndexPostsCacheKey())
+	// 書き込めなかった投稿は fanned_out = 0 のまま、読むときに引く
+	if err = fanoutPost(post); err != nil {
+		fmt.Printf("error fan out post (ID: %d): %s\n", post.ID, err.Error())
+	}
+	publishInvalidation(postCreated{Post: post})
+	enqueueNotifications(mentions...)
 
 	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
 	return
@@ -968,11 +1577,30 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 
 	postID, ierr := strconv.Atoi(r.FormValue("post_id"))
 	if ierr != nil {
-		fmt.Println("post_idは整数のみです")
+		redirectWithNotice(w, r, "/", "投稿が見つかりません")
 		return
 	}
+	postURL := fmt.Sprintf("/posts/%d", postID)
 
-	err := appendComment(postID, &me, r.FormValue("comment"))
+	if err := validateAuthor(me); err != nil {
+		redirectWithNotice(w, r, postURL, err.Error())
+		return
+	}
+	comment, verr := validateComment(r.FormValue("comment"))
+	if verr != nil {
+		redirectWithNotice(w, r, postURL, verr.Error())
+		return
+	}
+	if err := validateCommentTarget(postID, me); err != nil {
+		if _, ok := err.(*validationError); ok {
+			redirectWithNotice(w, r, "/", err.Error())
+			return
+		}
+		fmt.Println(err.Error())
+		return
+	}
+
+	err := appendComment(postID, &me, comment)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -983,18 +1611,23 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 
 func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+
+	q := r.URL.Query().Get("q")
+
+	users := []User{}
+	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 AND `account_name` LIKE CONCAT(?, '%') ORDER BY `created_at` DESC", escapeLike(q))
+	if err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	bans, err := getActiveBans(q)
+	if err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	history, err := getBanHistory(q, 50)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -1005,53 +1638,111 @@ func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 		getTemplPath("banned.html")),
 	).Execute(w, struct {
 		Users     []User
+		Bans      []UserBan
+		History   []UserBan
+		Durations []banDuration
+		Query     string
 		Me        User
 		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+		Flash     string
+	}{users, bans, history, banDurations, q, me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+func postAdminBanned(c web.C, w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
 		return
 	}
 
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	expiresAt, err := parseBanDuration(r.FormValue("expires_in"))
+	if reason == "" || err != nil {
+		session := getSession(r)
+		if reason == "" {
+			session.Values["notice"] = "BAN の理由を入力してください"
+		} else {
+			session.Values["notice"] = "BAN の期限が正しくありません"
+		}
+		session.Save(r, w)
+		http.Redirect(w, r, "/admin/banned", http.StatusFound)
 		return
 	}
 
+	r.ParseForm()
+	uids := []int{}
+	notice := ""
+	for _, id := range r.Form["uid[]"] {
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		ok, err := banUser(newAuditActor(c, r, me), uid, reason, expiresAt)
+		if n := banNotice(err); n != "" {
+			notice = n
+			continue
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if ok {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) > 0 {
+		publishInvalidation(userBanned{UserIDs: uids})
+	}
+	if notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
+
+func postAdminUnban(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
 	if r.FormValue("csrf_token") != getCSRFToken(r) {
 		w.WriteHeader(StatusUnprocessableEntity)
 		return
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
-
 	r.ParseForm()
+	uids := []int{}
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
 		uid, err := strconv.Atoi(id)
 		if err != nil {
-			go func() {
-				banUserOnCache(uid)
-			}()
+			continue
+		}
+		ok, err := unbanUser(newAuditActor(c, r, me), uid)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if ok {
+			uids = append(uids, uid)
 		}
 	}
-
-	postMtx.Lock()
-	memcacheClient.Delete(getIndexPostsCacheKey())
-	postMtx.Unlock()
+	if len(uids) > 0 {
+		publishInvalidation(userUnbanned{UserIDs: uids})
+	}
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
 }
 
-func main() {
-	// go func() {
-	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
-	// }()
+func openDB() *sqlx.DB {
+	conn, err := sqlx.Open("mysql", mysqlDSN())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	}
+	return conn
+}
 
+func mysqlDSN() string {
 	host := os.Getenv("ISUCONP_DB_HOST")
 	if host == "" {
 		host = "localhost"
@@ -1074,7 +1765,7 @@ func main() {
 		dbname = "isuconp"
 	}
 
-	dsn := fmt.Sprintf(
+	return fmt.Sprintf(
 		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local",
 		user,
 		password,
@@ -1082,27 +1773,81 @@ func main() {
 		port,
 		dbname,
 	)
+}
 
-	db, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+// サブコマンド。引数なしで起動した場合はアプリケーションサーバーとして動く
+var commands = map[string]func(args []string){
+	"bench":               runBench,
+	"analyze":             runAnalyze,
+	"reconcile":           runReconcile,
+	"verify-audit":        runVerifyAudit,
+	"reindex-tags":        runReindexTags,
+	"create-search-index": runCreateSearchIndex,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
 	}
+
+	initServer()
+
+	// go func() {
+	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
+	// }()
+
+	db = openDB()
 	defer db.Close()
 
-	goji.Get("/initialize", getInitialize)
-	goji.Get("/login", getLogin)
-	goji.Post("/login", postLogin)
-	goji.Get("/register", getRegister)
-	goji.Post("/register", postRegister)
-	goji.Get("/logout", getLogout)
-	goji.Get("/", getIndex)
-	goji.Get(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)$`), getAccountName)
-	goji.Get("/posts", getPosts)
-	goji.Get("/posts/:id", getPostsID)
-	goji.Post("/", postIndex)
-	goji.Post("/comment", postComment)
-	goji.Get("/admin/banned", getAdminBanned)
-	goji.Post("/admin/banned", postAdminBanned)
-	goji.Get("/*", http.FileServer(http.Dir("../../../public")))
+	if err := ensureCounterSchema(); err != nil {
+		log.Fatalf("Failed to create counter tables: %s.", err.Error())
+	}
+	if err := ensureBanSchema(); err != nil {
+		log.Fatalf("Failed to create ban tables: %s.", err.Error())
+	}
+	if err := ensureAuditSchema(); err != nil {
+		log.Fatalf("Failed to create audit tables: %s.", err.Error())
+	}
+	if err := ensureRoleSchema(); err != nil {
+		log.Fatalf("Failed to create role tables: %s.", err.Error())
+	}
+	if err := ensureModerationSchema(); err != nil {
+		log.Fatalf("Failed to create moderation tables: %s.", err.Error())
+	}
+	if err := ensurePostEditSchema(); err != nil {
+		log.Fatalf("Failed to add post columns: %s.", err.Error())
+	}
+	if err := ensureCommentEditSchema(); err != nil {
+		log.Fatalf("Failed to create comment edit tables: %s.", err.Error())
+	}
+	if err := ensureTagSchema(); err != nil {
+		log.Fatalf("Failed to create tag tables: %s.", err.Error())
+	}
+	if err := ensureMentionSchema(); err != nil {
+		log.Fatalf("Failed to create mention tables: %s.", err.Error())
+	}
+	if err := ensureNotificationSchema(); err != nil {
+		log.Fatalf("Failed to create notification tables: %s.", err.Error())
+	}
+	if err := ensureFollowSchema(); err != nil {
+		log.Fatalf("Failed to create follow tables: %s.", err.Error())
+	}
+	if err := ensureLikeSchema(); err != nil {
+		log.Fatalf("Failed to create like tables: %s.", err.Error())
+	}
+	if err := ensureBlockSchema(); err != nil {
+		log.Fatalf("Failed to create block tables: %s.", err.Error())
+	}
+	go writeNotifications()
+	if err := setupSearcher(); err != nil {
+		log.Fatalf("Failed to set up search: %s.", err.Error())
+	}
+	go watchDeletedPostImages(time.Hour)
+	go watchBanExpiry(time.Minute)
+
+	registerRoutes()
 	goji.Serve()
 }
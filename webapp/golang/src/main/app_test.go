@@ -0,0 +1,317 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji"
+)
+
+var testAccountSeq int64
+
+// createTestUser は account_name の後ろに連番を付けたユーザーを作る。パスワードは account_name と同じ
+func createTestUser(tb testing.TB, prefix string) User {
+	name := prefix + strconv.FormatInt(atomic.AddInt64(&testAccountSeq, 1), 10)
+	result, err := db.Exec("INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", name, calculatePasshash(name, name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	u := User{}
+	if err = db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid); err != nil {
+		tb.Fatal(err)
+	}
+	publishInvalidation(userRegistered{User: u})
+	return u
+}
+
+// createTestPost は画像の無い投稿を作る
+func createTestPost(tb testing.TB, uid int, body string) Post {
+	tx, err := db.Beginx()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `fanned_out`) VALUES (?,?,?,?,0)", uid, "image/jpeg", "", body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pid, err := result.LastInsertId()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p := Post{ID: int(pid), UserID: uid, Body: body, Mime: "image/jpeg"}
+	if err = tx.Get(&p.CreatedAt, "SELECT `created_at` FROM `posts` WHERE `id` = ?", pid); err != nil {
+		tb.Fatal(err)
+	}
+	if err = incrPostCounters(tx, uid, p.ID); err != nil {
+		tb.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	publishInvalidation(postCreated{Post: p})
+	return p
+}
+
+func newTestClient(tb testing.TB) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func fetch(tb testing.TB, client *http.Client, req *http.Request) (int, string) {
+	res, err := client.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func get(tb testing.TB, client *http.Client, u string) (int, string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fetch(tb, client, req)
+}
+
+func postForm(tb testing.TB, client *http.Client, u string, form url.Values) (int, string) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return fetch(tb, client, req)
+}
+
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// login は createTestUser で作ったユーザーでログインし、page のフォームにある CSRF トークンを返す
+func login(tb testing.TB, client *http.Client, base string, u User, page string) string {
+	postForm(tb, client, base+"/login", url.Values{"account_name": {u.AccountName}, "password": {u.AccountName}})
+	_, body := get(tb, client, base+page)
+	m := csrfTokenRegexp.FindStringSubmatch(body)
+	if m == nil {
+		tb.Fatalf("no csrf_token in %s", page)
+	}
+	return m[1]
+}
+
+func selectsWithIn(table string) func(q string) bool {
+	return func(q string) bool {
+		return strings.HasPrefix(q, "SELECT") && strings.Contains(q, "FROM `"+table+"`") && strings.Contains(q, " IN (")
+	}
+}
+
+// makePosts は1ページ分のコメントを GetMulti 1回と IN クエリ高々1回で、
+// 投稿者とコメント投稿者を getUsers 1回 (GetMulti 1回と IN クエリ高々1回) で引く
+func TestMakePostsRoundTrips(t *testing.T) {
+	setupIntegration(t)
+
+	results, err := selectPostsPage(activeUserPostsCond, nil, postsPage{Limit: postsPerPage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != postsPerPage {
+		t.Fatalf("got %d posts, want %d", len(results), postsPerPage)
+	}
+
+	memcacheClient.DeleteAll()
+	for _, tc := range []struct {
+		name      string
+		maxSelect int
+	}{
+		{"cold", 1},
+		{"warm", 0},
+	} {
+		purgeLocalCaches()
+		roundTrips.reset()
+		posts, err := makePosts(results, User{}, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) == 0 {
+			t.Fatalf("%s: no posts", tc.name)
+		}
+		if n := roundTrips.countGets("comments:"); n != 1 {
+			t.Errorf("%s: comments GetMulti = %d, want 1", tc.name, n)
+		}
+		if n := roundTrips.countGets("user:"); n != 1 {
+			t.Errorf("%s: users GetMulti = %d, want 1", tc.name, n)
+		}
+		if n := roundTrips.countQueries(selectsWithIn("comments")); n > tc.maxSelect {
+			t.Errorf("%s: comments IN queries = %d, want <= %d", tc.name, n, tc.maxSelect)
+		}
+		if n := roundTrips.countQueries(selectsWithIn("users")); n > tc.maxSelect {
+			t.Errorf("%s: users IN queries = %d, want <= %d", tc.name, n, tc.maxSelect)
+		}
+	}
+}
+
+// 同じ投稿に同時にコメントしても、キャッシュ上のコメント一覧から抜け落ちない。go test -race で動かす
+func TestAppendCommentConcurrent(t *testing.T) {
+	setupIntegration(t)
+
+	user := createTestUser(t, "commenter")
+	post := createTestPost(t, user.ID, "concurrent comments")
+	// キャッシュに載せておき、appendCommentOnCache の CAS が競合するようにする
+	if _, err := getComments(post.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// CAS が失敗するのは他の書き込みが成功したときだけなので、casRetryLimit 並列までなら再試行を使い切らない
+	const n = casRetryLimit
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- appendComment(post.ID, &user, "comment "+strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fromDB, err := queryComments([]int{post.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromDB[post.ID]) != n {
+		t.Fatalf("DB has %d comments, want %d", len(fromDB[post.ID]), n)
+	}
+
+	item, err := memcacheClient.Get(getCommentsCacheKey(post.ID))
+	if err != nil {
+		t.Fatalf("comments are not cached: %s", err)
+	}
+	v, err := unwrapCacheValue(item.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := decodeComments(v.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != n {
+		t.Errorf("memcache has %d comments, want %d", len(cached), n)
+	}
+
+	purgeLocalCaches()
+	comments, err := getComments(post.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != n {
+		t.Errorf("getComments returned %d comments, want %d", len(comments), n)
+	}
+}
+
+// BAN したユーザーの投稿は、キャッシュ済みのページも含めてすぐにどの一覧からも消える
+func TestBannedUserPostsDisappear(t *testing.T) {
+	setupIntegration(t)
+	server := httptest.NewServer(goji.DefaultMux)
+	defer server.Close()
+
+	victim := createTestUser(t, "victim")
+	post := createTestPost(t, victim.ID, "banned soon")
+	admin := createTestUser(t, "admin")
+	if _, err := setUserRole(systemActor, admin.ID, roleAdmin, true); err != nil {
+		t.Fatal(err)
+	}
+	publishInvalidation(userRolesChanged{UserID: admin.ID})
+
+	maxCreatedAt := url.QueryEscape(time.Now().Add(time.Hour).Format(ISO8601_FORMAT))
+	pages := []string{
+		"/",
+		"/posts?max_created_at=" + maxCreatedAt,
+		"/posts/" + strconv.Itoa(post.ID),
+		"/@" + victim.AccountName,
+	}
+	marker := `id="pid_` + strconv.Itoa(post.ID) + `"`
+
+	// 先に表示してキャッシュに載せておく
+	guest := newTestClient(t)
+	for _, page := range pages {
+		status, body := get(t, guest, server.URL+page)
+		if status != http.StatusOK || !strings.Contains(body, marker) {
+			t.Fatalf("before ban: GET %s = %d, post shown = %v", page, status, strings.Contains(body, marker))
+		}
+	}
+
+	client := newTestClient(t)
+	token := login(t, client, server.URL, admin, "/admin/banned")
+	status, _ := postForm(t, client, server.URL+"/admin/banned", url.Values{
+		"csrf_token": {token},
+		"reason":     {"spam"},
+		"uid[]":      {strconv.Itoa(victim.ID)},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("POST /admin/banned = %d", status)
+	}
+	var delFlg int
+	if err := db.Get(&delFlg, "SELECT `del_flg` FROM `users` WHERE `id` = ?", victim.ID); err != nil {
+		t.Fatal(err)
+	}
+	if delFlg != 1 {
+		t.Fatal("user was not banned")
+	}
+
+	for _, page := range pages {
+		status, body := get(t, guest, server.URL+page)
+		if strings.Contains(body, marker) {
+			t.Errorf("after ban: GET %s (%d) still shows the post", page, status)
+		}
+	}
+	if status, _ := get(t, guest, server.URL+"/posts/"+strconv.Itoa(post.ID)); status != http.StatusNotFound {
+		t.Errorf("after ban: GET /posts/%d = %d, want 404", post.ID, status)
+	}
+}
+
+func BenchmarkMakePosts(b *testing.B) {
+	setupIntegration(b)
+
+	results, err := selectPostsPage(activeUserPostsCond, nil, postsPage{Limit: postsPerPage})
+	if err != nil {
+		b.Fatal(err)
+	}
+	roundTrips.reset()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// プロセス内キャッシュが効くと memcache に行かないので、毎回捨てて memcache 側の往復を測る
+		purgeLocalCaches()
+		if _, err := makePosts(results, User{}, "", false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(roundTrips.countGets("comments:"))/float64(b.N), "comment-gets/op")
+	b.ReportMetric(float64(roundTrips.countGets("user:"))/float64(b.N), "user-gets/op")
+	b.ReportMetric(float64(roundTrips.countQueries(func(string) bool { return true }))/float64(b.N), "queries/op")
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// 管理者による操作の監査ログ。行は追記するだけで更新も削除もしない。
+// 各行は直前の行のハッシュを含めたハッシュを持つので、途中の行を書き換えたり消したりすると
+// verifyAuditChain で検出できる。admin_audit_head は最後の行のハッシュで、追記を直列化するロックも兼ねる
+var auditSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `admin_audit_logs` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`actor_id` int NOT NULL," +
+		"`action` varchar(32) NOT NULL," +
+		"`target_type` varchar(32) NOT NULL," +
+		"`target_id` int NOT NULL," +
+		"`ip` varchar(64) NOT NULL," +
+		"`request_id` varchar(64) NOT NULL," +
+		"`before_value` text NOT NULL," +
+		"`after_value` text NOT NULL," +
+		"`created_at` datetime(6) NOT NULL," +
+		"`prev_hash` char(64) NOT NULL," +
+		"`hash` char(64) NOT NULL," +
+		"KEY `idx_actor_id` (`actor_id`)," +
+		"KEY `idx_action` (`action`)," +
+		"KEY `idx_target` (`target_type`, `target_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `admin_audit_head` (" +
+		"`id` tinyint NOT NULL PRIMARY KEY," +
+		"`hash` char(64) NOT NULL" +
+		") DEFAULT CHARSET=utf8mb4",
+	"INSERT IGNORE INTO `admin_audit_head` (`id`, `hash`) VALUES (1, '')",
+}
+
+const (
+	auditActionBan            = "ban"
+	auditActionUnban          = "unban"
+	auditActionInitialize     = "initialize"
+	auditActionGrantRole      = "grant_role"
+	auditActionRevokeRole     = "revoke_role"
+	auditActionHideContent    = "hide_content"
+	auditActionDismissReports = "dismiss_reports"
+	auditActionDeleteContent  = "delete_content"
+)
+
+var auditActions = []string{
+	auditActionBan,
+	auditActionUnban,
+	auditActionInitialize,
+	auditActionGrantRole,
+	auditActionRevokeRole,
+	auditActionHideContent,
+	auditActionDismissReports,
+	auditActionDeleteContent,
+}
+
+// auditActor は操作した人とリクエスト。UserID が 0 の場合は期限切れによる自動解除などシステムによる操作
+type auditActor struct {
+	UserID    int
+	IP        string
+	RequestID string
+}
+
+var systemActor = auditActor{}
+
+func newAuditActor(c web.C, r *http.Request, me User) auditActor {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return auditActor{UserID: me.ID, IP: ip, RequestID: middleware.GetReqID(c)}
+}
+
+type AuditLog struct {
+	ID          int       `db:"id"`
+	ActorID     int       `db:"actor_id"`
+	ActorName   string    `db:"actor_name"`
+	Action      string    `db:"action"`
+	TargetType  string    `db:"target_type"`
+	TargetID    int       `db:"target_id"`
+	IP          string    `db:"ip"`
+	RequestID   string    `db:"request_id"`
+	BeforeValue string    `db:"before_value"`
+	AfterValue  string    `db:"after_value"`
+	CreatedAt   time.Time `db:"created_at"`
+	PrevHash    string    `db:"prev_hash"`
+	Hash        string    `db:"hash"`
+}
+
+// computeHash は ID 以外のすべてのカラムと直前のハッシュからハッシュを計算する
+func (l *AuditLog) computeHash() string {
+	h := sha256.New()
+	for _, f := range []string{
+		l.PrevHash,
+		strconv.Itoa(l.ActorID),
+		l.Action,
+		l.TargetType,
+		strconv.Itoa(l.TargetID),
+		l.IP,
+		l.RequestID,
+		l.BeforeValue,
+		l.AfterValue,
+		strconv.FormatInt(l.CreatedAt.UnixNano(), 10),
+	} {
+		// 区切りを入れないと "ab" + "c" と "a" + "bc" が同じになる
+		fmt.Fprintf(h, "%d:%s;", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func ensureAuditSchema() error {
+	for _, q := range auditSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func auditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// appendAuditLog は tx の中で監査ログを1行追記する。操作と同じトランザクションで書くので、
+// ロールバックされた操作はログにも残らない
+func appendAuditLog(tx *sqlx.Tx, actor auditActor, action, targetType string, targetID int, before, after interface{}) error {
+	l := AuditLog{
+		ActorID:     actor.UserID,
+		Action:      action,
+		TargetType:  targetType,
+		TargetID:    targetID,
+		IP:          actor.IP,
+		RequestID:   actor.RequestID,
+		BeforeValue: auditValue(before),
+		AfterValue:  auditValue(after),
+		// DB に保存できる精度に揃えておかないと、読み直したときにハッシュが合わない
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	if err := tx.Get(&l.PrevHash, "SELECT `hash` FROM `admin_audit_head` WHERE `id` = 1 FOR UPDATE"); err != nil {
+		return err
+	}
+	l.Hash = l.computeHash()
+	_, err := tx.Exec(
+		"INSERT INTO `admin_audit_logs` (`actor_id`, `action`, `target_type`, `target_id`, `ip`, `request_id`, `before_value`, `after_value`, `created_at`, `prev_hash`, `hash`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		l.ActorID, l.Action, l.TargetType, l.TargetID, l.IP, l.RequestID, l.BeforeValue, l.AfterValue, l.CreatedAt, l.PrevHash, l.Hash,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `admin_audit_head` SET `hash` = ? WHERE `id` = 1", l.Hash)
+	return err
+}
+
+// appendAuditLogTx は監査ログだけを書く操作のために1行分のトランザクションを張る
+func appendAuditLogTx(actor auditActor, action, targetType string, targetID int, before, after interface{}) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err := appendAuditLog(tx, actor, action, targetType, targetID, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// verifyAuditChain は監査ログを先頭から辿ってハッシュを検証し、最初に壊れていた行の ID を返す。
+// 壊れていなければ 0 を返す
+func verifyAuditChain() (int, error) {
+	rows, err := db.Queryx("SELECT `id`, `actor_id`, '' AS `actor_name`, `action`, `target_type`, `target_id`, `ip`, `request_id`, `before_value`, `after_value`, `created_at`, `prev_hash`, `hash` FROM `admin_audit_logs` ORDER BY `id`")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	prev := ""
+	for rows.Next() {
+		l := AuditLog{}
+		if err := rows.StructScan(&l); err != nil {
+			return 0, err
+		}
+		if l.PrevHash != prev || l.computeHash() != l.Hash {
+			return l.ID, nil
+		}
+		prev = l.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// 末尾の行が消された場合は head と合わなくなる
+	head := ""
+	if err := db.Get(&head, "SELECT `hash` FROM `admin_audit_head` WHERE `id` = 1"); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if head != prev {
+		return -1, nil
+	}
+	return 0, nil
+}
+
+type auditFilter struct {
+	Actor    string
+	Action   string
+	TargetID int
+	// Before より小さい ID の行だけを返す。0 の場合は最新から
+	Before int
+}
+
+func parseAuditFilter(r *http.Request) auditFilter {
+	q := r.URL.Query()
+	f := auditFilter{Actor: q.Get("actor"), Action: q.Get("action")}
+	f.TargetID, _ = strconv.Atoi(q.Get("target_id"))
+	f.Before, _ = strconv.Atoi(q.Get("before"))
+	return f
+}
+
+func selectAuditLogs(f auditFilter, limit int) ([]AuditLog, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if f.Actor != "" {
+		where = append(where, "a.`account_name` = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "l.`action` = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetID != 0 {
+		where = append(where, "l.`target_id` = ?")
+		args = append(args, f.TargetID)
+	}
+	if f.Before != 0 {
+		where = append(where, "l.`id` < ?")
+		args = append(args, f.Before)
+	}
+	q := "SELECT l.*, IFNULL(a.`account_name`, '') AS `actor_name` FROM `admin_audit_logs` l LEFT JOIN `users` a ON a.`id` = l.`actor_id` WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY l.`id` DESC"
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+	logs := []AuditLog{}
+	err := db.Select(&logs, q, args...)
+	return logs, err
+}
+
+const auditLogsPerPage = 100
+
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	f := parseAuditFilter(r)
+	if r.URL.Query().Get("format") == "csv" {
+		writeAuditCSV(w, f)
+		return
+	}
+
+	logs, err := selectAuditLogs(f, auditLogsPerPage)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	nextURL := ""
+	if len(logs) == auditLogsPerPage {
+		q := r.URL.Query()
+		q.Set("before", strconv.Itoa(logs[len(logs)-1].ID))
+		nextURL = "/admin/audit?" + q.Encode()
+	}
+	csvQuery := r.URL.Query()
+	csvQuery.Del("before")
+	csvQuery.Set("format", "csv")
+
+	// 検証はすべての行を読むので、明示的に要求されたときだけ行う
+	verified, brokenID := false, 0
+	if r.URL.Query().Get("verify") == "1" {
+		brokenID, err = verifyAuditChain()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		verified = true
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("audit.html")),
+	).Execute(w, struct {
+		Logs     []AuditLog
+		Filter   auditFilter
+		Actions  []string
+		NextURL  string
+		CSVURL   string
+		Verified bool
+		BrokenID int
+		Me       User
+	}{logs, f, auditActions, nextURL, "/admin/audit?" + csvQuery.Encode(), verified, brokenID, me})
+}
+
+func writeAuditCSV(w http.ResponseWriter, f auditFilter) {
+	f.Before = 0
+	logs, err := selectAuditLogs(f, 0)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "actor_id", "actor_name", "action", "target_type", "target_id", "ip", "request_id", "before", "after", "prev_hash", "hash"})
+	for _, l := range logs {
+		cw.Write([]string{
+			strconv.Itoa(l.ID),
+			l.CreatedAt.Format(time.RFC3339Nano),
+			strconv.Itoa(l.ActorID),
+			l.ActorName,
+			l.Action,
+			l.TargetType,
+			strconv.Itoa(l.TargetID),
+			l.IP,
+			l.RequestID,
+			l.BeforeValue,
+			l.AfterValue,
+			l.PrevHash,
+			l.Hash,
+		})
+	}
+	cw.Flush()
+}
+
+func runVerifyAudit(args []string) {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	fs.Parse(args)
+
+	db = openDB()
+	defer db.Close()
+
+	brokenID, err := verifyAuditChain()
+	if err != nil {
+		log.Fatalf("Failed to verify audit log: %s", err.Error())
+	}
+	switch {
+	case brokenID > 0:
+		fmt.Printf("audit log is broken at id %d\n", brokenID)
+		os.Exit(1)
+	case brokenID < 0:
+		fmt.Println("audit log is broken: the last entries were removed")
+		os.Exit(1)
+	}
+	fmt.Println("audit log is intact")
+}
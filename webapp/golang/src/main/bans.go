@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// users.del_flg は現在 BAN されているかどうかだけを持ち、
+// 誰がいつ何の理由で BAN・解除したかは user_bans に履歴として残す。
+// unbanned_at が NULL の行がそのユーザーの現在の BAN
+var banSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `user_bans` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` int NOT NULL," +
+		"`admin_id` int NOT NULL," +
+		"`reason` text NOT NULL," +
+		"`expires_at` timestamp NULL DEFAULT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`unbanned_at` timestamp NULL DEFAULT NULL," +
+		"`unbanned_by` int DEFAULT NULL," +
+		"KEY `idx_user_id` (`user_id`, `unbanned_at`)," +
+		"KEY `idx_expires_at` (`unbanned_at`, `expires_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+type UserBan struct {
+	ID          int        `db:"id"`
+	UserID      int        `db:"user_id"`
+	AccountName string     `db:"account_name"`
+	AdminID     int        `db:"admin_id"`
+	AdminName   string     `db:"admin_name"`
+	Reason      string     `db:"reason"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UnbannedAt  *time.Time `db:"unbanned_at"`
+	// UnbannedBy は解除した管理者。期限切れによる自動解除の場合は 0
+	UnbannedBy   int    `db:"unbanned_by"`
+	UnbannerName string `db:"unbanner_name"`
+}
+
+type banDuration struct {
+	Value string
+	Label string
+}
+
+// BAN の期限の選択肢。空文字列は無期限
+var banDurations = []banDuration{
+	{"", "無期限"},
+	{"1h", "1時間"},
+	{"24h", "1日"},
+	{"168h", "7日"},
+	{"720h", "30日"},
+}
+
+func parseBanDuration(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, d := range banDurations {
+		if d.Value != s {
+			continue
+		}
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Now().Add(dur)
+		return &t, nil
+	}
+	return nil, fmt.Errorf("unknown ban duration: %s", s)
+}
+
+func ensureBanSchema() error {
+	for _, q := range banSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const userBanColumns = "b.`id`, b.`user_id`, u.`account_name`, b.`admin_id`, IFNULL(a.`account_name`, '') AS `admin_name`, " +
+	"b.`reason`, b.`expires_at`, b.`created_at`, b.`unbanned_at`, IFNULL(b.`unbanned_by`, 0) AS `unbanned_by`, IFNULL(ub.`account_name`, '') AS `unbanner_name` " +
+	"FROM `user_bans` b JOIN `users` u ON u.`id` = b.`user_id` " +
+	"LEFT JOIN `users` a ON a.`id` = b.`admin_id` " +
+	"LEFT JOIN `users` ub ON ub.`id` = b.`unbanned_by` "
+
+// getActiveBans は現在 BAN 中のユーザーを返す。accountName が空でなければ前方一致で絞り込む。
+// 初期データのように user_bans に行の無い BAN も Reason 無しで含める
+func getActiveBans(accountName string) ([]UserBan, error) {
+	bans := []UserBan{}
+	err := db.Select(&bans,
+		"SELECT IFNULL(b.`id`, 0) AS `id`, u.`id` AS `user_id`, u.`account_name`, IFNULL(b.`admin_id`, 0) AS `admin_id`, IFNULL(a.`account_name`, '') AS `admin_name`, "+
+			"IFNULL(b.`reason`, '') AS `reason`, b.`expires_at`, IFNULL(b.`created_at`, u.`created_at`) AS `created_at`, NULL AS `unbanned_at`, 0 AS `unbanned_by`, '' AS `unbanner_name` "+
+			"FROM `users` u LEFT JOIN `user_bans` b ON b.`user_id` = u.`id` AND b.`unbanned_at` IS NULL "+
+			"LEFT JOIN `users` a ON a.`id` = b.`admin_id` "+
+			"WHERE u.`del_flg` = 1 AND u.`account_name` LIKE CONCAT(?, '%') ORDER BY `created_at` DESC, u.`id` DESC",
+		escapeLike(accountName))
+	return bans, err
+}
+
+// getBanHistory は BAN と解除の履歴を新しい順に limit 件返す
+func getBanHistory(accountName string, limit int) ([]UserBan, error) {
+	bans := []UserBan{}
+	err := db.Select(&bans, "SELECT "+userBanColumns+
+		"WHERE u.`account_name` LIKE CONCAT(?, '%') ORDER BY b.`id` DESC LIMIT ?",
+		escapeLike(accountName), limit)
+	return bans, err
+}
+
+func escapeLike(s string) string {
+	r := make([]rune, 0, len(s))
+	for _, c := range s {
+		if c == '%' || c == '_' || c == '\\' {
+			r = append(r, '\\')
+		}
+		r = append(r, c)
+	}
+	return string(r)
+}
+
+// checkBanTarget は actor が持っていない権限を uid のユーザーが持っていれば errOutranked を返す。
+// 最後の admin を BAN するとロールを付与し直せなくなるので、そのときは errLastAdmin を返す
+func checkBanTarget(tx *sqlx.Tx, actor auditActor, uid int) error {
+	targetRoles := []string{}
+	if err := tx.Select(&targetRoles, "SELECT `role` FROM `user_roles` WHERE `user_id` = ? FOR UPDATE", uid); err != nil {
+		return err
+	}
+	if len(targetRoles) == 0 {
+		return nil
+	}
+	actorRoles := []string{}
+	if err := tx.Select(&actorRoles, "SELECT `role` FROM `user_roles` WHERE `user_id` = ?", actor.UserID); err != nil {
+		return err
+	}
+	perms := rolesPermissions(actorRoles)
+	for p := range rolesPermissions(targetRoles) {
+		if !perms[p] {
+			return errOutranked
+		}
+	}
+	for _, role := range targetRoles {
+		if role != roleAdmin {
+			continue
+		}
+		admins := 0
+		err := tx.Get(&admins, "SELECT COUNT(*) FROM `user_roles` r JOIN `users` u ON u.`id` = r.`user_id` WHERE r.`role` = ? AND r.`user_id` != ? AND u.`del_flg` = 0", roleAdmin, uid)
+		if err != nil {
+			return err
+		}
+		if admins == 0 {
+			return errLastAdmin
+		}
+	}
+	return nil
+}
+
+// banNotice は banUser が断ったときに管理画面に出すメッセージを返す。断ったのでなければ空文字列
+func banNotice(err error) string {
+	switch err {
+	case errOutranked:
+		return "自分に無い権限を持つユーザーは BAN できません"
+	case errLastAdmin:
+		return "最後の admin は BAN できません"
+	}
+	return ""
+}
+
+// banUser は uid のユーザーを BAN して履歴と監査ログを残す。既に BAN 中の場合は false を返す。
+// actor に無い権限を持つユーザーは BAN できない
+func banUser(actor auditActor, uid int, reason string, expiresAt *time.Time) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	if err = checkBanTarget(tx, actor, uid); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	result, err := tx.Exec("UPDATE `users` SET `del_flg` = 1 WHERE `id` = ? AND `del_flg` = 0", uid)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	_, err = tx.Exec("INSERT INTO `user_bans` (`user_id`, `admin_id`, `reason`, `expires_at`) VALUES (?,?,?,?)", uid, actor.UserID, reason, expiresAt)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	after := map[string]interface{}{"del_flg": 1, "reason": reason, "expires_at": expiresAt}
+	if err = appendAuditLog(tx, actor, auditActionBan, "user", uid, map[string]interface{}{"del_flg": 0}, after); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// unbanUser は uid のユーザーの BAN を解除する。actor が systemActor の場合は期限切れによる自動解除。
+// BAN 中でなかった場合は false を返す
+func unbanUser(actor auditActor, uid int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec("UPDATE `users` SET `del_flg` = 0 WHERE `id` = ? AND `del_flg` = 1", uid)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	var unbannedBy interface{}
+	if actor.UserID != 0 {
+		unbannedBy = actor.UserID
+	}
+	_, err = tx.Exec("UPDATE `user_bans` SET `unbanned_at` = NOW(), `unbanned_by` = ? WHERE `user_id` = ? AND `unbanned_at` IS NULL", unbannedBy, uid)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = appendAuditLog(tx, actor, auditActionUnban, "user", uid, map[string]interface{}{"del_flg": 1}, map[string]interface{}{"del_flg": 0}); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// expireBans は期限を過ぎた BAN を解除し、解除したユーザーの ID を返す
+func expireBans() ([]int, error) {
+	uids := []int{}
+	err := db.Select(&uids, "SELECT DISTINCT `user_id` FROM `user_bans` WHERE `unbanned_at` IS NULL AND `expires_at` <= NOW()")
+	if err != nil {
+		return nil, err
+	}
+	unbanned := []int{}
+	for _, uid := range uids {
+		ok, err := unbanUser(systemActor, uid)
+		if err != nil {
+			return unbanned, err
+		}
+		if ok {
+			unbanned = append(unbanned, uid)
+		}
+	}
+	return unbanned, nil
+}
+
+// watchBanExpiry は interval ごとに期限切れの BAN を解除する。
+// 複数のプロセスで動いても、解除は del_flg の更新で1つのプロセスにしか成功しない
+func watchBanExpiry(interval time.Duration) {
+	for range time.Tick(interval) {
+		uids, err := expireBans()
+		if err != nil {
+			fmt.Printf("error expiring bans: %s\n", err.Error())
+		}
+		if len(uids) > 0 {
+			publishInvalidation(userUnbanned{UserIDs: uids})
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// モデレーターは自分に無い権限を持つ admin を BAN できない
+func TestBanUserOutranked(t *testing.T) {
+	setupIntegration(t)
+
+	mod := createTestUser(t, "mod")
+	admin := createTestUser(t, "admin")
+	target := createTestUser(t, "target")
+	for _, g := range []struct {
+		uid  int
+		role string
+	}{{mod.ID, roleModerator}, {admin.ID, roleAdmin}} {
+		if _, err := setUserRole(systemActor, g.uid, g.role, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actor := auditActor{UserID: mod.ID}
+
+	if _, err := banUser(actor, admin.ID, "test", nil); err != errOutranked {
+		t.Errorf("ban admin by moderator: err = %v, want %v", err, errOutranked)
+	}
+	delFlg := 0
+	if err := db.Get(&delFlg, "SELECT `del_flg` FROM `users` WHERE `id` = ?", admin.ID); err != nil {
+		t.Fatal(err)
+	}
+	if delFlg != 0 {
+		t.Error("admin was banned by a moderator")
+	}
+
+	ok, err := banUser(actor, target.ID, "test", nil)
+	if err != nil || !ok {
+		t.Errorf("ban user by moderator: ok = %v, err = %v", ok, err)
+	}
+}
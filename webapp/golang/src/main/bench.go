@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// 負荷走行中に1リクエストあたりに加算するスコア。記載のないものは1点
+var benchScoreWeights = map[string]int{
+	"POST /":         5,
+	"POST /comment":  2,
+	"POST /register": 2,
+	"POST /login":    2,
+}
+
+const benchFailurePenalty = 10
+
+var (
+	benchCSRFTokenRe = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+	benchCreatedAtRe = regexp.MustCompile(`data-created-at="([^"]+)"`)
+	benchPostIDRe    = regexp.MustCompile(`id="pid_(\d+)"`)
+	benchPostPathRe  = regexp.MustCompile(`^/posts/(\d+)$`)
+
+	errBenchUnexpectedStatus = errors.New("unexpected status")
+)
+
+type benchStat struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	failures  []string
+}
+
+func newBenchStat() *benchStat {
+	return &benchStat{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+func (s *benchStat) record(label string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[label] = append(s.latencies[label], d)
+}
+
+func (s *benchStat) fail(label string, format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[label]++
+	if len(s.failures) < 100 {
+		s.failures = append(s.failures, label+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *benchStat) score() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score := 0
+	for label, ls := range s.latencies {
+		w, ok := benchScoreWeights[label]
+		if !ok {
+			w = 1
+		}
+		score += w * (len(ls) - s.errors[label])
+	}
+	for _, n := range s.errors {
+		score -= benchFailurePenalty * n
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+func (s *benchStat) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	labels := []string{}
+	for label := range s.latencies {
+		labels = append(labels, label)
+	}
+	for label := range s.errors {
+		if _, ok := s.latencies[label]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "endpoint\tcount\terrors\tavg(ms)\tp50(ms)\tp99(ms)\tmax(ms)\t")
+	for _, label := range labels {
+		ls := append([]time.Duration{}, s.latencies[label]...)
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		var sum time.Duration
+		for _, d := range ls {
+			sum += d
+		}
+		avg, p50, p99, max := 0.0, 0.0, 0.0, 0.0
+		if len(ls) > 0 {
+			avg = msec(sum) / float64(len(ls))
+			p50 = msec(ls[percentileIndex(len(ls), 50)])
+			p99 = msec(ls[percentileIndex(len(ls), 99)])
+			max = msec(ls[len(ls)-1])
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t\n", label, len(ls), s.errors[label], avg, p50, p99, max)
+	}
+	tw.Flush()
+
+	if len(s.failures) > 0 {
+		fmt.Fprintln(w, "\nfailures:")
+		for _, f := range s.failures {
+			fmt.Fprintln(w, "  "+f)
+		}
+	}
+}
+
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func percentileIndex(n, p int) int {
+	i := (n*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+type benchAgent struct {
+	target      string
+	client      *http.Client
+	stat        *benchStat
+	accountName string
+	password    string
+	csrfToken   string
+}
+
+func newBenchAgent(target string, stat *benchStat, timeout time.Duration) *benchAgent {
+	jar, _ := cookiejar.New(nil)
+	return &benchAgent{
+		target: strings.TrimRight(target, "/"),
+		stat:   stat,
+		client: &http.Client{
+			Jar:     jar,
+			Timeout: timeout,
+			// リダイレクト先を検証するので自動では追わない
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (a *benchAgent) do(label, method, p string, body io.Reader, contentType string, wantStatus int) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, a.target+p, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	start := time.Now()
+	res, err := a.client.Do(req)
+	if err != nil {
+		a.stat.record(label, time.Since(start))
+		a.stat.fail(label, "%s %s: %s", method, p, err.Error())
+		return nil, nil, err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	a.stat.record(label, time.Since(start))
+	if err != nil {
+		a.stat.fail(label, "%s %s: %s", method, p, err.Error())
+		return nil, nil, err
+	}
+	if res.StatusCode != wantStatus {
+		a.stat.fail(label, "%s %s: status %d, want %d", method, p, res.StatusCode, wantStatus)
+		return res, b, errBenchUnexpectedStatus
+	}
+	return res, b, nil
+}
+
+func (a *benchAgent) get(label, p string) ([]byte, error) {
+	_, b, err := a.do(label, "GET", p, nil, "", http.StatusOK)
+	return b, err
+}
+
+func (a *benchAgent) postForm(label, p string, v url.Values, wantLocation string) (string, error) {
+	res, _, err := a.do(label, "POST", p, strings.NewReader(v.Encode()), "application/x-www-form-urlencoded", http.StatusFound)
+	if err != nil {
+		return "", err
+	}
+	return a.checkLocation(label, res, wantLocation)
+}
+
+func (a *benchAgent) checkLocation(label string, res *http.Response, wantLocation string) (string, error) {
+	loc := res.Header.Get("Location")
+	if u, err := url.Parse(loc); err == nil {
+		loc = u.Path
+	}
+	if wantLocation != "" && loc != wantLocation {
+		a.stat.fail(label, "redirected to %q, want %q", loc, wantLocation)
+		return loc, errBenchUnexpectedStatus
+	}
+	return loc, nil
+}
+
+func (a *benchAgent) check(label string, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		a.stat.fail(label, format, args...)
+	}
+	return ok
+}
+
+func (a *benchAgent) register() error {
+	a.accountName = benchRandomName(10)
+	a.password = benchRandomName(12)
+	if _, err := a.get("GET /register", "/register"); err != nil {
+		return err
+	}
+	_, err := a.postForm("POST /register", "/register", url.Values{
+		"account_name": {a.accountName},
+		"password":     {a.password},
+	}, "/")
+	if err != nil {
+		return err
+	}
+	return a.loadIndex()
+}
+
+func (a *benchAgent) login(accountName, password string) error {
+	a.accountName, a.password = accountName, password
+	if _, err := a.get("GET /login", "/login"); err != nil {
+		return err
+	}
+	_, err := a.postForm("POST /login", "/login", url.Values{
+		"account_name": {accountName},
+		"password":     {password},
+	}, "/")
+	if err != nil {
+		return err
+	}
+	return a.loadIndex()
+}
+
+func (a *benchAgent) logout() error {
+	res, _, err := a.do("GET /logout", "GET", "/logout", nil, "", http.StatusFound)
+	if err != nil {
+		return err
+	}
+	_, err = a.checkLocation("GET /logout", res, "/")
+	return err
+}
+
+// loadIndex はトップページを取得し、フォームからCSRFトークンを取り出す
+func (a *benchAgent) loadIndex() error {
+	b, err := a.get("GET /", "/")
+	if err != nil {
+		return err
+	}
+	if a.accountName != "" && !a.check("GET /", bytes.Contains(b, []byte(`<span class="isu-account-name">`+a.accountName+`</span>`)), "not logged in as %s", a.accountName) {
+		return errBenchUnexpectedStatus
+	}
+	m := benchCSRFTokenRe.FindSubmatch(b)
+	if !a.check("GET /", m != nil, "csrf_token not found") {
+		return errBenchUnexpectedStatus
+	}
+	a.csrfToken = string(m[1])
+	return nil
+}
+
+func (a *benchAgent) postImage() (int, error) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="bench.png"`)
+	h.Set("Content-Type", "image/png")
+	fw, err := mw.CreatePart(h)
+	if err != nil {
+		return 0, err
+	}
+	if err := png.Encode(fw, benchRandomImage()); err != nil {
+		return 0, err
+	}
+	caption := "bench " + benchRandomName(16)
+	mw.WriteField("body", caption)
+	mw.WriteField("csrf_token", a.csrfToken)
+	mw.Close()
+
+	res, _, err := a.do("POST /", "POST", "/", body, mw.FormDataContentType(), http.StatusFound)
+	if err != nil {
+		return 0, err
+	}
+	loc, _ := a.checkLocation("POST /", res, "")
+	m := benchPostPathRe.FindStringSubmatch(loc)
+	if !a.check("POST /", m != nil, "redirected to %q after upload", loc) {
+		return 0, errBenchUnexpectedStatus
+	}
+	pid, _ := strconv.Atoi(m[1])
+
+	b, err := a.get("GET /posts/:id", loc)
+	if err != nil {
+		return 0, err
+	}
+	imagePath := "/image/" + m[1] + ".png"
+	if !a.check("GET /posts/:id", bytes.Contains(b, []byte(imagePath)) && bytes.Contains(b, []byte(caption)), "post %d does not show the uploaded image", pid) {
+		return 0, errBenchUnexpectedStatus
+	}
+	if _, err := a.get("GET /image/:id", imagePath); err != nil {
+		return 0, err
+	}
+	return pid, nil
+}
+
+func (a *benchAgent) postComment(pid int) error {
+	comment := "bench comment " + benchRandomName(16)
+	p := "/posts/" + strconv.Itoa(pid)
+	_, err := a.postForm("POST /comment", "/comment", url.Values{
+		"post_id":    {strconv.Itoa(pid)},
+		"comment":    {comment},
+		"csrf_token": {a.csrfToken},
+	}, p)
+	if err != nil {
+		return err
+	}
+	b, err := a.get("GET /posts/:id", p)
+	if err != nil {
+		return err
+	}
+	if !a.check("GET /posts/:id", bytes.Contains(b, []byte(comment)), "comment not found on post %d", pid) {
+		return errBenchUnexpectedStatus
+	}
+	return nil
+}
+
+// paginate はトップページから /posts?max_created_at= を辿り、投稿が新しい順に並んでいるかを確認する
+func (a *benchAgent) paginate(pages int) ([]int, error) {
+	b, err := a.get("GET /", "/")
+	if err != nil {
+		return nil, err
+	}
+	pids := benchPostIDs(b)
+	for i := 0; i < pages; i++ {
+		ms := benchCreatedAtRe.FindAllSubmatch(b, -1)
+		if len(ms) == 0 {
+			break
+		}
+		maxCreatedAt := string(ms[len(ms)-1][1])
+		max, err := time.Parse(ISO8601_FORMAT, maxCreatedAt)
+		if !a.check("GET /posts", err == nil, "invalid data-created-at %q", maxCreatedAt) {
+			return pids, errBenchUnexpectedStatus
+		}
+
+		b, err = a.get("GET /posts", "/posts?max_created_at="+url.QueryEscape(maxCreatedAt))
+		if err != nil {
+			return pids, err
+		}
+		for _, m := range benchCreatedAtRe.FindAllSubmatch(b, -1) {
+			t, err := time.Parse(ISO8601_FORMAT, string(m[1]))
+			if !a.check("GET /posts", err == nil && !t.After(max), "post created at %s is newer than max_created_at %s", m[1], maxCreatedAt) {
+				return pids, errBenchUnexpectedStatus
+			}
+		}
+		pids = append(pids, benchPostIDs(b)...)
+	}
+	return pids, nil
+}
+
+func (a *benchAgent) visitUser(accountName string) error {
+	b, err := a.get("GET /@:accountName", "/@"+accountName)
+	if err != nil {
+		return err
+	}
+	if !a.check("GET /@:accountName", bytes.Contains(b, []byte(`<span class="isu-user-account-name">`+accountName+`さん</span>`)), "user page of %s not rendered", accountName) {
+		return errBenchUnexpectedStatus
+	}
+	return nil
+}
+
+// ban は管理者ページから accountName のユーザーを探して BAN する
+func (a *benchAgent) ban(accountName string) error {
+	b, err := a.get("GET /admin/banned", "/admin/banned")
+	if err != nil {
+		return err
+	}
+	uidRe := regexp.MustCompile(`value="(\d+)" data-account-name="` + regexp.QuoteMeta(accountName) + `"`)
+	m := uidRe.FindSubmatch(b)
+	if !a.check("GET /admin/banned", m != nil, "%s is not listed", accountName) {
+		return errBenchUnexpectedStatus
+	}
+	t := benchCSRFTokenRe.FindSubmatch(b)
+	if !a.check("GET /admin/banned", t != nil, "csrf_token not found") {
+		return errBenchUnexpectedStatus
+	}
+	_, err = a.postForm("POST /admin/banned", "/admin/banned", url.Values{
+		"uid[]":      {string(m[1])},
+		"reason":     {"bench"},
+		"csrf_token": {string(t[1])},
+	}, "/admin/banned")
+	return err
+}
+
+// checkBanned は BAN されたユーザーの投稿がトップページと /posts から消えていることを確認する
+func (a *benchAgent) checkBanned(accountName string, pid int) {
+	link := []byte(`href="/@` + accountName + `"`)
+	pidAttr := []byte(`id="pid_` + strconv.Itoa(pid) + `"`)
+	if b, err := a.get("GET /", "/"); err == nil {
+		a.check("GET /", !bytes.Contains(b, link) && !bytes.Contains(b, pidAttr), "banned user %s still appears on /", accountName)
+	}
+	maxCreatedAt := time.Now().Add(time.Minute).Format(ISO8601_FORMAT)
+	if b, err := a.get("GET /posts", "/posts?max_created_at="+url.QueryEscape(maxCreatedAt)); err == nil {
+		a.check("GET /posts", !bytes.Contains(b, link) && !bytes.Contains(b, pidAttr), "banned user %s still appears on /posts", accountName)
+	}
+}
+
+func benchPostIDs(b []byte) []int {
+	pids := []int{}
+	for _, m := range benchPostIDRe.FindAllSubmatch(b, -1) {
+		pid, err := strconv.Atoi(string(m[1]))
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// アカウント名のルーティングは英字のみを受け付けるので英字だけで作る
+func benchRandomName(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func benchRandomImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	c := color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 255}
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+type benchConfig struct {
+	target        string
+	concurrency   int
+	duration      time.Duration
+	timeout       time.Duration
+	pages         int
+	initialize    bool
+	adminAccount  string
+	adminPassword string
+	banInterval   time.Duration
+}
+
+func benchUserScenario(cfg *benchConfig, stat *benchStat, deadline time.Time) {
+	for time.Now().Before(deadline) {
+		a := newBenchAgent(cfg.target, stat, cfg.timeout)
+		if err := a.register(); err != nil {
+			continue
+		}
+		pid, err := a.postImage()
+		if err != nil {
+			continue
+		}
+		a.postComment(pid)
+
+		pids, _ := a.paginate(cfg.pages)
+		if len(pids) > 0 {
+			a.postComment(pids[rand.Intn(len(pids))])
+		}
+		a.visitUser(a.accountName)
+
+		if err := a.logout(); err != nil {
+			continue
+		}
+		a.login(a.accountName, a.password)
+	}
+}
+
+func benchBanScenario(cfg *benchConfig, stat *benchStat, deadline time.Time) {
+	admin := newBenchAgent(cfg.target, stat, cfg.timeout)
+	if err := admin.login(cfg.adminAccount, cfg.adminPassword); err != nil {
+		return
+	}
+	for time.Now().Add(cfg.banInterval).Before(deadline) {
+		time.Sleep(cfg.banInterval)
+
+		victim := newBenchAgent(cfg.target, stat, cfg.timeout)
+		if err := victim.register(); err != nil {
+			continue
+		}
+		pid, err := victim.postImage()
+		if err != nil {
+			continue
+		}
+		if err := admin.ban(victim.accountName); err != nil {
+			continue
+		}
+		admin.checkBanned(victim.accountName, pid)
+	}
+}
+
+func runBench(args []string) {
+	cfg := &benchConfig{}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&cfg.target, "target", "http://localhost", "Target base URL")
+	fs.IntVar(&cfg.concurrency, "c", 4, "Number of concurrent user scenarios")
+	fs.DurationVar(&cfg.duration, "d", time.Minute, "Benchmark duration")
+	fs.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "Timeout per request")
+	fs.IntVar(&cfg.pages, "pages", 3, "Number of /posts pages to follow per scenario")
+	fs.BoolVar(&cfg.initialize, "initialize", true, "Request /initialize before starting")
+	fs.StringVar(&cfg.adminAccount, "admin-account", "", "Admin account name for the ban scenario (disabled if empty)")
+	fs.StringVar(&cfg.adminPassword, "admin-password", "", "Admin password for the ban scenario")
+	fs.DurationVar(&cfg.banInterval, "ban-interval", 5*time.Second, "Interval between bans")
+	fs.Parse(args)
+
+	rand.Seed(time.Now().UnixNano())
+	stat := newBenchStat()
+
+	if cfg.initialize {
+		a := newBenchAgent(cfg.target, stat, 30*time.Second)
+		if _, err := a.get("GET /initialize", "/initialize"); err != nil {
+			stat.report(os.Stdout)
+			os.Exit(1)
+		}
+	}
+
+	deadline := time.Now().Add(cfg.duration)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			benchUserScenario(cfg, stat, deadline)
+		}()
+	}
+	if cfg.adminAccount != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			benchBanScenario(cfg, stat, deadline)
+		}()
+	}
+	wg.Wait()
+
+	stat.report(os.Stdout)
+	fmt.Printf("\nscore: %d\n", stat.score())
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/zenazn/goji/web"
+)
+
+// ミュートしたユーザーの投稿とコメントは自分の画面に出さない。
+// ブロックはそれに加えて、相手が自分の投稿を見たりコメントしたりできないようにする
+var blockSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `blocks` (" +
+		"`user_id` int NOT NULL," +
+		"`target_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `target_id`)," +
+		"KEY `idx_target_id` (`target_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `mutes` (" +
+		"`user_id` int NOT NULL," +
+		"`target_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `target_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	relationBlock = "blocks"
+	relationMute  = "mutes"
+)
+
+var userFilterCachePolicy = cachePolicy{ttl: 10 * time.Minute}
+
+func ensureBlockSchema() error {
+	for _, q := range blockSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userFilter は閲覧者ごとの、表示から除くユーザーと自分をブロックしているユーザー
+type userFilter struct {
+	Muted     map[int]bool
+	Blocked   map[int]bool
+	BlockedBy map[int]bool
+}
+
+// hides は uid のユーザーの投稿やコメントを閲覧者に出さないか
+func (f userFilter) hides(uid int) bool {
+	return f.Muted[uid] || f.Blocked[uid]
+}
+
+func getUserFilterCacheKey(uid int) string {
+	return "user_filter:" + strconv.Itoa(uid)
+}
+
+func queryUserFilter(uid int) (userFilter, error) {
+	f := userFilter{Muted: map[int]bool{}, Blocked: map[int]bool{}, BlockedBy: map[int]bool{}}
+	queries := []struct {
+		query string
+		ids   map[int]bool
+	}{
+		{"SELECT `target_id` FROM `mutes` WHERE `user_id` = ?", f.Muted},
+		{"SELECT `target_id` FROM `blocks` WHERE `user_id` = ?", f.Blocked},
+		{"SELECT `user_id` FROM `blocks` WHERE `target_id` = ?", f.BlockedBy},
+	}
+	for _, q := range queries {
+		ids := []int{}
+		if err := db.Select(&ids, q.query, uid); err != nil {
+			return f, err
+		}
+		for _, id := range ids {
+			q.ids[id] = true
+		}
+	}
+	return f, nil
+}
+
+// getUserFilter は閲覧者 uid の userFilter を返す。ログインしていなければ何も除かない
+func getUserFilter(uid int) (userFilter, error) {
+	if uid == 0 {
+		return userFilter{}, nil
+	}
+	key := getUserFilterCacheKey(uid)
+	if item, err := memcacheClient.Get(key); err == nil {
+		v, err := unwrapCacheValue(item.Value)
+		var f userFilter
+		if err == nil {
+			f, err = decodeUserFilter(v.payload)
+		}
+		if err == nil {
+			return f, nil
+		}
+	} else if err != memcache.ErrCacheMiss {
+		fmt.Println(err)
+	}
+
+	v, err := cacheLoadGroup.Do(key, func() (interface{}, error) {
+		start := time.Now()
+		f, err := queryUserFilter(uid)
+		if err != nil {
+			return nil, err
+		}
+		memcacheClient.Add(userFilterCachePolicy.item(key, encodeUserFilter(f), time.Since(start)))
+		return f, nil
+	})
+	if err != nil {
+		return userFilter{}, err
+	}
+	return v.(userFilter), nil
+}
+
+func reloadUserFilterOnCache(uid int) {
+	err := casReplace(getUserFilterCacheKey(uid), userFilterCachePolicy, func() ([]byte, error) {
+		f, err := queryUserFilter(uid)
+		if err != nil {
+			return nil, err
+		}
+		return encodeUserFilter(f), nil
+	})
+	if err != nil {
+		fmt.Printf("error reload user filter on cache (ID: %d): %s\n", uid, err.Error())
+	}
+}
+
+// setRelation は uid のユーザーから target へのブロックやミュートを on にする。
+// ブロックしたときはお互いのフォローも外す
+func setRelation(table string, uid, target int, on bool) error {
+	var err error
+	if on {
+		_, err = db.Exec("INSERT IGNORE INTO `"+table+"` (`user_id`, `target_id`) VALUES (?,?)", uid, target)
+	} else {
+		_, err = db.Exec("DELETE FROM `"+table+"` WHERE `user_id` = ? AND `target_id` = ?", uid, target)
+	}
+	if err != nil {
+		return err
+	}
+	if table == relationBlock && on {
+		if err := unfollowUser(uid, target); err != nil {
+			return err
+		}
+		if err := unfollowUser(target, uid); err != nil {
+			return err
+		}
+	}
+	publishInvalidation(userFilterChanged{UserIDs: []int{uid, target}})
+	return nil
+}
+
+// resetBlocks は初期化でブロックとミュートを消し、memcache に残った userFilter も消す
+func resetBlocks() error {
+	uids := []int{}
+	err := db.Select(&uids, "SELECT `user_id` FROM `blocks` UNION SELECT `target_id` FROM `blocks` UNION SELECT `user_id` FROM `mutes`")
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{relationBlock, relationMute} {
+		if _, err := db.Exec("DELETE FROM `" + table + "`"); err != nil {
+			return err
+		}
+	}
+	for _, uid := range uids {
+		memcacheClient.Delete(getUserFilterCacheKey(uid))
+	}
+	return nil
+}
+
+type relationAction struct {
+	table string
+	on    bool
+}
+
+var relationActions = map[string]relationAction{
+	"block":   {relationBlock, true},
+	"unblock": {relationBlock, false},
+	"mute":    {relationMute, true},
+	"unmute":  {relationMute, false},
+}
+
+// postAccountNameRelation は /@:accountName/:action の block, unblock, mute, unmute を受け付ける
+func postAccountNameRelation(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	action, ok := relationActions[c.URLParams["action"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ?", c.URLParams["accountName"])
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if user.ID == me.ID {
+		redirectWithNotice(w, r, "/@"+user.AccountName, "自分自身はブロック・ミュートできません")
+		return
+	}
+
+	if err := setRelation(action.table, me.ID, user.ID, action.on); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	redirectTo := r.FormValue("redirect")
+	if redirectTo != "/blocks" {
+		redirectTo = "/@" + user.AccountName
+	}
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+func getRelationUsers(table string, uid int) ([]User, error) {
+	users := []User{}
+	err := db.Select(&users, "SELECT u.`id`, u.`account_name` FROM `"+table+"` t JOIN `users` u ON u.`id` = t.`target_id` "+
+		"WHERE t.`user_id` = ? ORDER BY t.`created_at` DESC", uid)
+	return users, err
+}
+
+// getBlocks はブロック・ミュートしているユーザーの一覧
+func getBlocks(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	blocked, err := getRelationUsers(relationBlock, me.ID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	muted, err := getRelationUsers(relationMute, me.ID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("blocks.html")),
+	).Execute(w, struct {
+		Blocked   []User
+		Muted     []User
+		Me        User
+		CSRFToken string
+	}{blocked, muted, me, getCSRFToken(r)})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// flightGroup はキャッシュミス時の読み込みをキーごとに1つにまとめる (golang.org/x/sync/singleflight 相当)
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
+
+var cacheLoadGroup flightGroup
+
+// flightKey は複数 ID をまとめて読み込むときのキー。同じ ID の組み合わせなら同じキーになる
+func flightKey(prefix string, ids []int) string {
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+	s := make([]string, len(sorted))
+	for i, id := range sorted {
+		s[i] = strconv.Itoa(id)
+	}
+	return prefix + strings.Join(s, ",")
+}
+
+// cachePolicy は名前空間ごとの memcache 上での寿命
+type cachePolicy struct {
+	ttl time.Duration
+	// keepStale が true の場合は ttl を過ぎても memcache から消さず、
+	// 古い値を返しながら裏で1つのゴルーチンだけが作り直す (stale-while-revalidate)
+	keepStale bool
+}
+
+var (
+	userCachePolicy       = cachePolicy{ttl: 10 * time.Minute}
+	commentCachePolicy    = cachePolicy{ttl: 10 * time.Minute}
+	indexPostsCachePolicy = cachePolicy{ttl: 5 * time.Second, keepStale: true}
+)
+
+func (p cachePolicy) item(key string, payload []byte, delta time.Duration) *memcache.Item {
+	return p.itemUntil(key, payload, time.Now().Add(p.ttl), delta)
+}
+
+func (p cachePolicy) itemUntil(key string, payload []byte, expires time.Time, delta time.Duration) *memcache.Item {
+	item := &memcache.Item{Key: key, Value: wrapCacheValue(payload, expires, delta)}
+	if !p.keepStale {
+		sec := int32(time.Until(expires) / time.Second)
+		if sec < 1 {
+			sec = 1
+		}
+		item.Expiration = sec
+	}
+	return item
+}
+
+func (v cacheValue) stale() bool {
+	return time.Now().After(v.expires)
+}
+
+// 早期期限切れ (XFetch) の係数。大きいほど期限より早めに作り直す
+const xfetchBeta = 1.0
+
+// shouldRefreshEarly は期限が近い値ほど高い確率で true を返す。
+// 期限切れの瞬間に読み込みが集中しないよう、たまたま当たったリクエストだけが先に作り直す
+func (v cacheValue) shouldRefreshEarly() bool {
+	r := rand.Float64()
+	if r == 0 {
+		return true
+	}
+	gap := time.Duration(-float64(v.delta) * xfetchBeta * math.Log(r))
+	return !time.Now().Add(gap).Before(v.expires)
+}
+
+// refreshItems は早期期限切れと判定された items を load の結果で置き換える。
+// 読んでから書き換えられた値は CAS で弾かれるので上書きしない
+func refreshItems(prefix string, p cachePolicy, items map[int]*memcache.Item, load func(ids []int) (map[int][]byte, error)) {
+	ids := make([]int, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	_, err := cacheLoadGroup.Do(flightKey("refresh:"+prefix, ids), func() (interface{}, error) {
+		start := time.Now()
+		payloads, err := load(ids)
+		if err != nil {
+			return nil, err
+		}
+		delta := time.Since(start)
+		for id, item := range items {
+			payload, ok := payloads[id]
+			if !ok {
+				continue
+			}
+			newItem := p.item(item.Key, payload, delta)
+			item.Value, item.Expiration = newItem.Value, newItem.Expiration
+			memcacheClient.CompareAndSwap(item)
+		}
+		cacheStats.Add(prefix+".refresh", int64(len(items)))
+		return nil, nil
+	})
+	if err != nil {
+		fmt.Printf("error refreshing %s cache: %s\n", prefix, err.Error())
+	}
+}
+
+const casRetryLimit = 10
+
+// casUpdate は key のキャッシュを CompareAndSwap で読み書きする。
+// modify が nil を返した場合は更新しない。キャッシュが無いときは load の結果を Add し、
+// 他のリクエストが先に入れていた場合はその値に対して modify をやり直す。
+// modify による更新では元の値の期限を引き継ぐ
+func casUpdate(key string, p cachePolicy, load func() ([]byte, error), modify func(payload []byte) ([]byte, error)) error {
+	for i := 0; i < casRetryLimit; i++ {
+		item, err := memcacheClient.Get(key)
+		if err == memcache.ErrCacheMiss {
+			if load == nil {
+				return nil
+			}
+			start := time.Now()
+			payload, err := load()
+			if err != nil {
+				return err
+			}
+			err = memcacheClient.Add(p.item(key, payload, time.Since(start)))
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		v, err := unwrapCacheValue(item.Value)
+		var payload []byte
+		if err == nil {
+			payload, err = modify(v.payload)
+		}
+		if err == errCacheDecode {
+			// 古い形式の値は消して load からやり直す
+			memcacheClient.Delete(key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if payload == nil {
+			return nil
+		}
+		newItem := p.itemUntil(key, payload, v.expires, v.delta)
+		item.Value, item.Expiration = newItem.Value, newItem.Expiration
+		err = memcacheClient.CompareAndSwap(item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
+
+	// 競合し続けた場合は古い値を残さないよう消しておき、次の読み込みで DB から作り直す
+	fmt.Printf("cas retry limit exceeded: %s\n", key)
+	return memcacheClient.Delete(key)
+}
+
+// casReplace は key のキャッシュを load の結果で作り直す。
+// 作り直している間に casUpdate で書き換えられた場合は load からやり直す
+func casReplace(key string, p cachePolicy, load func() ([]byte, error)) error {
+	for i := 0; i < casRetryLimit; i++ {
+		item, err := memcacheClient.Get(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		start := time.Now()
+		payload, lerr := load()
+		if lerr != nil {
+			return lerr
+		}
+		newItem := p.item(key, payload, time.Since(start))
+		if err == memcache.ErrCacheMiss {
+			err = memcacheClient.Add(newItem)
+		} else {
+			item.Value, item.Expiration = newItem.Value, newItem.Expiration
+			err = memcacheClient.CompareAndSwap(item)
+		}
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
+
+	fmt.Printf("cas retry limit exceeded: %s\n", key)
+	return memcacheClient.Delete(key)
+}
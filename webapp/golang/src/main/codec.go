@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// キャッシュに入れる値のエンコード形式。
+// 先頭1バイトがバージョンで、形式を変えたときはこれを上げる。
+// バージョンが違う値や壊れた値は errCacheDecode になり、呼び出し側はキャッシュミスとして扱う
+const cacheCodecVersion byte = 2
+
+var errCacheDecode = errors.New("cache: cannot decode value")
+
+type cacheEncoder struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func newCacheEncoder() *cacheEncoder {
+	return &cacheEncoder{buf: []byte{cacheCodecVersion}}
+}
+
+func (e *cacheEncoder) int(v int64) {
+	n := binary.PutVarint(e.tmp[:], v)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+func (e *cacheEncoder) uint(v uint64) {
+	n := binary.PutUvarint(e.tmp[:], v)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+func (e *cacheEncoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cacheEncoder) time(t time.Time) {
+	e.int(t.UnixNano())
+}
+
+type cacheDecoder struct {
+	buf []byte
+	err error
+}
+
+func newCacheDecoder(b []byte) *cacheDecoder {
+	if len(b) == 0 || b[0] != cacheCodecVersion {
+		return &cacheDecoder{err: errCacheDecode}
+	}
+	return &cacheDecoder{buf: b[1:]}
+}
+
+func (d *cacheDecoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCacheDecode
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *cacheDecoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCacheDecode
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *cacheDecoder) string() string {
+	l := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < l {
+		d.err = errCacheDecode
+		return ""
+	}
+	s := string(d.buf[:l])
+	d.buf = d.buf[l:]
+	return s
+}
+
+func (d *cacheDecoder) time() time.Time {
+	return time.Unix(0, d.int())
+}
+
+// optionalTime は nil を 0 として書く
+func (e *cacheEncoder) optionalTime(t *time.Time) {
+	if t == nil {
+		e.int(0)
+		return
+	}
+	e.time(*t)
+}
+
+func (d *cacheDecoder) optionalTime() *time.Time {
+	v := d.int()
+	if v == 0 {
+		return nil
+	}
+	t := time.Unix(0, v)
+	return &t
+}
+
+// length は要素数を読む。残りのバイト数より多い要素数は壊れた値とみなす
+func (d *cacheDecoder) length() int {
+	l := d.uint()
+	if d.err == nil && l > uint64(len(d.buf)) {
+		d.err = errCacheDecode
+	}
+	return int(l)
+}
+
+func (d *cacheDecoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errCacheDecode
+	}
+	return d.err
+}
+
+// ユーザーは Passhash を含めずにキャッシュする
+func (e *cacheEncoder) user(u User) {
+	e.int(int64(u.ID))
+	e.string(u.AccountName)
+	e.int(int64(u.Authority))
+	e.int(int64(u.DelFlg))
+	e.time(u.CreatedAt)
+}
+
+func (d *cacheDecoder) user() User {
+	return User{
+		ID:          int(d.int()),
+		AccountName: d.string(),
+		Authority:   int(d.int()),
+		DelFlg:      int(d.int()),
+		CreatedAt:   d.time(),
+	}
+}
+
+func encodeUser(u User) []byte {
+	e := newCacheEncoder()
+	e.user(u)
+	return e.buf
+}
+
+func decodeUser(b []byte) (User, error) {
+	d := newCacheDecoder(b)
+	u := d.user()
+	return u, d.finish()
+}
+
+// コメントの User は makePosts で詰めるのでキャッシュしない
+func encodeComments(comments []Comment) []byte {
+	e := newCacheEncoder()
+	e.uint(uint64(len(comments)))
+	for _, c := range comments {
+		e.int(int64(c.ID))
+		e.int(int64(c.PostID))
+		e.int(int64(c.UserID))
+		e.string(c.Comment)
+		e.time(c.CreatedAt)
+		e.optionalTime(c.EditedAt)
+	}
+	return e.buf
+}
+
+func decodeComments(b []byte) ([]Comment, error) {
+	d := newCacheDecoder(b)
+	n := d.length()
+	comments := make([]Comment, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		comments = append(comments, Comment{
+			ID:        int(d.int()),
+			PostID:    int(d.int()),
+			UserID:    int(d.int()),
+			Comment:   d.string(),
+			CreatedAt: d.time(),
+			EditedAt:  d.optionalTime(),
+		})
+	}
+	return comments, d.finish()
+}
+
+// 投稿は一覧表示に必要なカラムだけをキャッシュする (Imgdata, Comments, User, CSRFToken は含めない)
+func encodePosts(posts []Post) []byte {
+	e := newCacheEncoder()
+	e.uint(uint64(len(posts)))
+	for _, p := range posts {
+		e.int(int64(p.ID))
+		e.int(int64(p.UserID))
+		e.string(p.Body)
+		e.string(p.Mime)
+		e.time(p.CreatedAt)
+	}
+	return e.buf
+}
+
+func decodePosts(b []byte) ([]Post, error) {
+	d := newCacheDecoder(b)
+	n := d.length()
+	posts := make([]Post, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		posts = append(posts, Post{
+			ID:        int(d.int()),
+			UserID:    int(d.int()),
+			Body:      d.string(),
+			Mime:      d.string(),
+			CreatedAt: d.time(),
+		})
+	}
+	return posts, d.finish()
+}
+
+func (e *cacheEncoder) idSet(ids map[int]bool) {
+	e.uint(uint64(len(ids)))
+	for id := range ids {
+		e.int(int64(id))
+	}
+}
+
+func (d *cacheDecoder) idSet() map[int]bool {
+	n := d.length()
+	ids := make(map[int]bool, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		ids[int(d.int())] = true
+	}
+	return ids
+}
+
+func encodeUserFilter(f userFilter) []byte {
+	e := newCacheEncoder()
+	e.idSet(f.Muted)
+	e.idSet(f.Blocked)
+	e.idSet(f.BlockedBy)
+	return e.buf
+}
+
+func decodeUserFilter(b []byte) (userFilter, error) {
+	d := newCacheDecoder(b)
+	f := userFilter{Muted: d.idSet(), Blocked: d.idSet(), BlockedBy: d.idSet()}
+	return f, d.finish()
+}
+
+// memcache に入れる値はすべて、期限と再計算にかかった時間を持つ封筒で包む。
+// 期限は stale-while-revalidate と早期期限切れの判定に使う。
+// 先頭バイトは上位ビットを立てて cacheCodecVersion と重ならないようにし、封筒の無い古い値を封筒と読み違えないようにする
+const cacheEnvelopeVersion byte = 0x80 | 1
+
+type cacheValue struct {
+	payload []byte
+	expires time.Time
+	delta   time.Duration
+}
+
+func wrapCacheValue(payload []byte, expires time.Time, delta time.Duration) []byte {
+	e := &cacheEncoder{buf: []byte{cacheEnvelopeVersion}}
+	e.time(expires)
+	e.int(int64(delta))
+	e.buf = append(e.buf, payload...)
+	return e.buf
+}
+
+func unwrapCacheValue(b []byte) (cacheValue, error) {
+	if len(b) == 0 || b[0] != cacheEnvelopeVersion {
+		return cacheValue{}, errCacheDecode
+	}
+	d := &cacheDecoder{buf: b[1:]}
+	v := cacheValue{expires: d.time(), delta: time.Duration(d.int())}
+	if d.err != nil {
+		return cacheValue{}, d.err
+	}
+	v.payload = d.buf
+	return v, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ベンチマーク用の値は1ページ分の投稿とそのコメントを想定した大きさにする
+func sampleComments() []Comment {
+	now := time.Unix(1500000000, 123456789)
+	comments := make([]Comment, 0, 10)
+	for i := 0; i < 10; i++ {
+		c := Comment{ID: 100000 + i, PostID: 9000, UserID: 500 + i, Comment: "コメント" + strings.Repeat("です", i), CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if i%3 == 0 {
+			edited := c.CreatedAt.Add(time.Minute)
+			c.EditedAt = &edited
+		}
+		comments = append(comments, c)
+	}
+	return comments
+}
+
+func sampleUsers() []User {
+	users := make([]User, 0, 20)
+	for i := 0; i < 20; i++ {
+		users = append(users, User{ID: 500 + i, AccountName: "account" + strconv.Itoa(i), Authority: i % 2, CreatedAt: time.Unix(1500000000+int64(i), 0)})
+	}
+	return users
+}
+
+func samplePosts() []Post {
+	posts := make([]Post, 0, postsPerPage)
+	for i := 0; i < postsPerPage; i++ {
+		posts = append(posts, Post{ID: 9000 + i, UserID: 500 + i, Body: "今日の一枚 #猫 " + strings.Repeat("キャプション", i), Mime: "image/jpeg", CreatedAt: time.Unix(1500000000+int64(i), 0)})
+	}
+	return posts
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	comments := sampleComments()
+	gotComments, err := decodeComments(encodeComments(comments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotComments) != len(comments) {
+		t.Fatalf("decoded %d comments, want %d", len(gotComments), len(comments))
+	}
+	for i, c := range comments {
+		got := gotComments[i]
+		if got.ID != c.ID || got.PostID != c.PostID || got.UserID != c.UserID || got.Comment != c.Comment ||
+			!got.CreatedAt.Equal(c.CreatedAt) || (got.EditedAt == nil) != (c.EditedAt == nil) ||
+			(c.EditedAt != nil && !got.EditedAt.Equal(*c.EditedAt)) {
+			t.Errorf("comment %d: got %+v, want %+v", i, got, c)
+		}
+	}
+
+	for _, u := range sampleUsers() {
+		got, err := decodeUser(encodeUser(u))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != u.ID || got.AccountName != u.AccountName || got.Authority != u.Authority || got.DelFlg != u.DelFlg || !got.CreatedAt.Equal(u.CreatedAt) {
+			t.Errorf("got %+v, want %+v", got, u)
+		}
+	}
+
+	posts := samplePosts()
+	gotPosts, err := decodePosts(encodePosts(posts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range posts {
+		got := gotPosts[i]
+		got.CreatedAt = p.CreatedAt
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("post %d: got %+v, want %+v", i, got, p)
+		}
+	}
+}
+
+func TestCodecRejectsBrokenValue(t *testing.T) {
+	b := encodeComments(sampleComments())
+	for _, broken := range [][]byte{nil, b[:len(b)/2], append([]byte{cacheCodecVersion + 1}, b[1:]...)} {
+		if _, err := decodeComments(broken); err == nil {
+			t.Errorf("decodeComments(%q) succeeded", broken)
+		}
+	}
+}
+
+func TestUnwrapCacheValue(t *testing.T) {
+	payload := encodeComments(sampleComments())
+	expires := time.Unix(1500000000, 0)
+	v, err := unwrapCacheValue(wrapCacheValue(payload, expires, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.expires.Equal(expires) || v.delta != time.Second || string(v.payload) != string(payload) {
+		t.Errorf("got %+v", v)
+	}
+
+	// 封筒を導入する前に入れられた値は封筒として読まない
+	for version := byte(1); version <= cacheCodecVersion; version++ {
+		old := append([]byte{version}, payload[1:]...)
+		if _, err := unwrapCacheValue(old); err != errCacheDecode {
+			t.Errorf("unwrapCacheValue(codec v%d) error = %v, want errCacheDecode", version, err)
+		}
+	}
+}
+
+func BenchmarkEncodeComments(b *testing.B) {
+	comments := sampleComments()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = len(encodeComments(comments))
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkEncodeCommentsJSON(b *testing.B) {
+	comments := sampleComments()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		v, _ := json.Marshal(comments)
+		n = len(v)
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkDecodeComments(b *testing.B) {
+	v := encodeComments(sampleComments())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeComments(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeCommentsJSON(b *testing.B) {
+	v, _ := json.Marshal(sampleComments())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var comments []Comment
+		if err := json.Unmarshal(v, &comments); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeUsers(b *testing.B) {
+	users := sampleUsers()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = 0
+		for _, u := range users {
+			n += len(encodeUser(u))
+		}
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkEncodeUsersJSON(b *testing.B) {
+	users := sampleUsers()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = 0
+		for _, u := range users {
+			v, _ := json.Marshal(u)
+			n += len(v)
+		}
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkDecodeUsers(b *testing.B) {
+	var values [][]byte
+	for _, u := range sampleUsers() {
+		values = append(values, encodeUser(u))
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, v := range values {
+			if _, err := decodeUser(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeUsersJSON(b *testing.B) {
+	var values [][]byte
+	for _, u := range sampleUsers() {
+		v, _ := json.Marshal(u)
+		values = append(values, v)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, v := range values {
+			var u User
+			if err := json.Unmarshal(v, &u); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodePosts(b *testing.B) {
+	posts := samplePosts()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = len(encodePosts(posts))
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkEncodePostsJSON(b *testing.B) {
+	posts := samplePosts()
+	b.ReportAllocs()
+	var n int
+	for i := 0; i < b.N; i++ {
+		v, _ := json.Marshal(posts)
+		n = len(v)
+	}
+	b.ReportMetric(float64(n), "bytes")
+}
+
+func BenchmarkDecodePosts(b *testing.B) {
+	v := encodePosts(samplePosts())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodePosts(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePostsJSON(b *testing.B) {
+	v, _ := json.Marshal(samplePosts())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var posts []Post
+		if err := json.Unmarshal(v, &posts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// コメントの編集と削除。編集は投稿者だけ、削除は投稿者・コメントされた投稿の投稿者・
+// delete_content 権限を持つユーザーができる。編集前の本文は comment_edits に残す
+var commentEditSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `comment_edits` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`comment_id` int NOT NULL," +
+		"`comment` text NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_comment_id` (`comment_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+func ensureCommentEditSchema() error {
+	for _, q := range commentEditSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	if err := addColumnIfNotExists("comments", "edited_at", "timestamp NULL DEFAULT NULL"); err != nil {
+		return err
+	}
+	return addColumnIfNotExists("comments", "deleted_at", "timestamp NULL DEFAULT NULL")
+}
+
+// managedComment は編集・削除の対象のコメントと、権限の判定に使うコメントされた投稿の投稿者
+type managedComment struct {
+	Comment
+	PostUserID int  `db:"post_user_id"`
+	Hidden     bool `db:"hidden"`
+}
+
+// sqlGetter は *sqlx.DB と *sqlx.Tx のどちらでも読めるようにするためのもの
+type sqlGetter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
+func getManagedComment(q sqlGetter, cid int, forUpdate bool) (managedComment, error) {
+	c := managedComment{}
+	query := "SELECT c.`id`, c.`post_id`, c.`user_id`, c.`comment`, c.`created_at`, c.`edited_at`, p.`user_id` AS `post_user_id`, c.`hidden_at` IS NOT NULL AS `hidden` " +
+		"FROM `comments` c JOIN `posts` p ON p.`id` = c.`post_id` WHERE c.`id` = ? AND c.`deleted_at` IS NULL"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	err := q.Get(&c, query, cid)
+	return c, err
+}
+
+func (c managedComment) canEdit(me User) bool {
+	return isLogin(me) && c.UserID == me.ID
+}
+
+// canDelete は me が c を削除できるかどうか。moderator は me が delete_content 権限を持っているかどうか
+func (c managedComment) canDelete(me User, moderator bool) bool {
+	return isLogin(me) && (c.UserID == me.ID || c.PostUserID == me.ID || moderator)
+}
+
+type CommentEdit struct {
+	Comment   string    `db:"comment"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func getCommentEdits(cid int) ([]CommentEdit, error) {
+	edits := []CommentEdit{}
+	err := db.Select(&edits, "SELECT `comment`, `created_at` FROM `comment_edits` WHERE `comment_id` = ? ORDER BY `id` DESC", cid)
+	return edits, err
+}
+
+func commentIDParam(c web.C) (int, bool) {
+	cid, err := strconv.Atoi(c.URLParams["id"])
+	return cid, err == nil
+}
+
+// getCommentsIDEdit は編集フォームと編集履歴を表示する。履歴は誰でも見られる
+func getCommentsIDEdit(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	cid, ok := commentIDParam(c)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	mc, err := getManagedComment(db, cid, false)
+	if err == sql.ErrNoRows || (err == nil && mc.Hidden) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	edits, err := getCommentEdits(cid)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("comment_edit.html")),
+	).Execute(w, struct {
+		Comment   managedComment
+		Edits     []CommentEdit
+		CanEdit   bool
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{mc, edits, mc.canEdit(me), me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postCommentsIDEdit(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	cid, ok := commentIDParam(c)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, verr := validateComment(r.FormValue("comment"))
+	if verr != nil {
+		redirectWithNotice(w, r, fmt.Sprintf("/comments/%d/edit", cid), verr.Error())
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	mc, err := getManagedComment(tx, cid, true)
+	if err == sql.ErrNoRows || (err == nil && !mc.canEdit(me)) {
+		tx.Rollback()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	if mc.Comment.Comment == body {
+		tx.Rollback()
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d", mc.PostID), http.StatusFound)
+		return
+	}
+
+	if _, err := tx.Exec("INSERT INTO `comment_edits` (`comment_id`, `comment`) VALUES (?,?)", cid, mc.Comment.Comment); err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE `comments` SET `comment` = ?, `edited_at` = ? WHERE `id` = ?", body, now, cid); err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	mentions, err := setMentions(tx, mentionSource{mentionSourceComment, cid, mc.PostID, mc.UserID}, body)
+	if err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	updated := mc.Comment
+	updated.Comment, updated.EditedAt = body, &now
+	publishInvalidation(commentUpdated{Comment: updated})
+	enqueueNotifications(mentions...)
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", mc.PostID), http.StatusFound)
+}
+
+func postCommentsIDDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	cid, ok := commentIDParam(c)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	moderator, err := hasPermission(me, permDeleteContent)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	mc, err := getManagedComment(tx, cid, true)
+	if err == sql.ErrNoRows || (err == nil && !mc.canDelete(me, moderator)) {
+		tx.Rollback()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+
+	err = func() error {
+		if _, err := tx.Exec("UPDATE `comments` SET `deleted_at` = NOW() WHERE `id` = ?", cid); err != nil {
+			return err
+		}
+		// 非表示にしたときに既に減らしている
+		if !mc.Hidden {
+			if err := addCommentCounters(tx, mc.UserID, mc.PostID, -1); err != nil {
+				return err
+			}
+		}
+		// 本人や投稿者以外による削除は管理者の操作として残す
+		if mc.UserID != me.ID && mc.PostUserID != me.ID {
+			return appendAuditLog(tx, newAuditActor(c, r, me), auditActionDeleteContent, reportTargetComment, cid, map[string]interface{}{"comment": mc.Comment.Comment}, nil)
+		}
+		return nil
+	}()
+	if err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	publishInvalidation(commentDeleted{PostID: mc.PostID, CommentID: cid})
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", mc.PostID), http.StatusFound)
+}
+
+// updateCommentOnCache はキャッシュ済みの c の投稿のコメント一覧で c を置き換える
+func updateCommentOnCache(c Comment) error {
+	return casUpdate(getCommentsCacheKey(c.PostID), commentCachePolicy, nil, func(value []byte) ([]byte, error) {
+		comments, err := decodeComments(value)
+		if err != nil {
+			return nil, err
+		}
+		for i := range comments {
+			if comments[i].ID == c.ID {
+				comments[i].Comment, comments[i].EditedAt = c.Comment, c.EditedAt
+				return encodeComments(comments), nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// removeCommentOnCache はキャッシュ済みの postID の投稿のコメント一覧から cid を除く
+func removeCommentOnCache(postID, cid int) error {
+	return casUpdate(getCommentsCacheKey(postID), commentCachePolicy, nil, func(value []byte) ([]byte, error) {
+		comments, err := decodeComments(value)
+		if err != nil {
+			return nil, err
+		}
+		for i := range comments {
+			if comments[i].ID == cid {
+				return encodeComments(append(comments[:i], comments[i+1:]...)), nil
+			}
+		}
+		return nil, nil
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ユーザーページや投稿のコメント数を毎回 COUNT しないためのカウンタ。
+// 書き込み時に同じトランザクションで更新し、ずれた場合は reconcileCounters で作り直す
+var counterSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `user_counters` (" +
+		"`user_id` int NOT NULL PRIMARY KEY," +
+		"`post_count` int NOT NULL DEFAULT 0," +
+		"`comment_count` int NOT NULL DEFAULT 0," +
+		"`commented_count` int NOT NULL DEFAULT 0" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `post_counters` (" +
+		"`post_id` int NOT NULL PRIMARY KEY," +
+		"`comment_count` int NOT NULL DEFAULT 0" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+type userCounter struct {
+	PostCount      int `db:"post_count"`
+	CommentCount   int `db:"comment_count"`
+	CommentedCount int `db:"commented_count"`
+	FollowerCount  int `db:"follower_count"`
+	FollowingCount int `db:"following_count"`
+}
+
+func ensureCounterSchema() error {
+	for _, q := range counterSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileCounters は posts と comments からカウンタをすべて計算し直す。非表示や削除された投稿・コメントは数えない
+func reconcileCounters() error {
+	sqls := []string{
+		"DELETE FROM `user_counters`",
+		"INSERT INTO `user_counters` (`user_id`) SELECT `id` FROM `users`",
+		"UPDATE `user_counters` uc JOIN (SELECT `user_id`, COUNT(*) AS cnt FROM `posts` WHERE `hidden_at` IS NULL AND `deleted_at` IS NULL GROUP BY `user_id`) t ON uc.`user_id` = t.`user_id` SET uc.`post_count` = t.cnt",
+		"UPDATE `user_counters` uc JOIN (SELECT `user_id`, COUNT(*) AS cnt FROM `comments` WHERE `hidden_at` IS NULL AND `deleted_at` IS NULL GROUP BY `user_id`) t ON uc.`user_id` = t.`user_id` SET uc.`comment_count` = t.cnt",
+		"UPDATE `user_counters` uc JOIN (SELECT p.`user_id`, COUNT(*) AS cnt FROM `comments` c JOIN `posts` p ON p.`id` = c.`post_id` WHERE c.`hidden_at` IS NULL AND c.`deleted_at` IS NULL GROUP BY p.`user_id`) t ON uc.`user_id` = t.`user_id` SET uc.`commented_count` = t.cnt",
+		"UPDATE `user_counters` uc JOIN (SELECT `followee_id`, COUNT(*) AS cnt FROM `follows` GROUP BY `followee_id`) t ON uc.`user_id` = t.`followee_id` SET uc.`follower_count` = t.cnt",
+		"UPDATE `user_counters` uc JOIN (SELECT `follower_id`, COUNT(*) AS cnt FROM `follows` GROUP BY `follower_id`) t ON uc.`user_id` = t.`follower_id` SET uc.`following_count` = t.cnt",
+		"DELETE FROM `post_counters`",
+		"INSERT INTO `post_counters` (`post_id`, `comment_count`) SELECT p.`id`, COUNT(c.`id`) FROM `posts` p LEFT JOIN `comments` c ON c.`post_id` = p.`id` AND c.`hidden_at` IS NULL AND c.`deleted_at` IS NULL GROUP BY p.`id`",
+		"UPDATE `post_counters` pc JOIN (SELECT `post_id`, COUNT(*) AS cnt FROM `likes` GROUP BY `post_id`) t ON pc.`post_id` = t.`post_id` SET pc.`like_count` = t.cnt",
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, q := range sqls {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 初期データのカウンタを写しておくテーブル。dbInitialize はここから戻すので集計し直さない
+var seedCounterTables = []struct {
+	table string
+	cond  string
+}{
+	{"user_counters", "`user_id` <= 1000"},
+	{"post_counters", "`post_id` <= 10000"},
+}
+
+// saveSeedCounters は初期データ分のカウンタを *_seed テーブルに写す。初期化した直後のデータで動かす
+func saveSeedCounters() error {
+	for _, t := range seedCounterTables {
+		sqls := []string{
+			"DROP TABLE IF EXISTS `" + t.table + "_seed`",
+			"CREATE TABLE `" + t.table + "_seed` LIKE `" + t.table + "`",
+			"INSERT INTO `" + t.table + "_seed` SELECT * FROM `" + t.table + "` WHERE " + t.cond,
+		}
+		for _, q := range sqls {
+			if _, err := db.Exec(q); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetCounters はカウンタを初期データの値に戻す。
+// *_seed テーブルが無いかカラムが合わないときは reconcileCounters で数え直し、次からはその値を使う
+func resetCounters() error {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN ('user_counters_seed', 'post_counters_seed')")
+	if err != nil {
+		return err
+	}
+	if n == len(seedCounterTables) {
+		if err = copySeedCounters(); err == nil {
+			return nil
+		}
+		fmt.Println("error restore seed counters: " + err.Error())
+	}
+
+	if err = reconcileCounters(); err != nil {
+		return err
+	}
+	return saveSeedCounters()
+}
+
+func copySeedCounters() error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, t := range seedCounterTables {
+		if _, err := tx.Exec("DELETE FROM `" + t.table + "`"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO `" + t.table + "` SELECT * FROM `" + t.table + "_seed`"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func incrPostCounters(tx *sqlx.Tx, uid, pid int) error {
+	if _, err := tx.Exec("INSERT INTO `post_counters` (`post_id`) VALUES (?)", pid); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO `user_counters` (`user_id`, `post_count`) VALUES (?, 1) ON DUPLICATE KEY UPDATE `post_count` = `post_count` + 1", uid)
+	return err
+}
+
+// addCommentCounters はコメントの追加 (delta = 1) や削除 (delta = -1) をカウンタに反映する
+func addCommentCounters(tx *sqlx.Tx, uid, pid, delta int) error {
+	if _, err := tx.Exec("INSERT INTO `post_counters` (`post_id`, `comment_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `comment_count` = `comment_count` + VALUES(`comment_count`)", pid, delta); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO `user_counters` (`user_id`, `comment_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `comment_count` = `comment_count` + VALUES(`comment_count`)", uid, delta); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO `user_counters` (`user_id`, `commented_count`) SELECT `user_id`, ? FROM `posts` WHERE `id` = ? ON DUPLICATE KEY UPDATE `commented_count` = `user_counters`.`commented_count` + VALUES(`commented_count`)", delta, pid)
+	return err
+}
+
+// addFollowCounters はフォロー (delta = 1) やフォロー解除 (delta = -1) をカウンタに反映する
+func addFollowCounters(tx *sqlx.Tx, followerID, followeeID, delta int) error {
+	if _, err := tx.Exec("INSERT INTO `user_counters` (`user_id`, `following_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `following_count` = `following_count` + VALUES(`following_count`)", followerID, delta); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO `user_counters` (`user_id`, `follower_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `follower_count` = `follower_count` + VALUES(`follower_count`)", followeeID, delta)
+	return err
+}
+
+func getUserCounter(uid int) (userCounter, error) {
+	c := userCounter{}
+	err := db.Get(&c, "SELECT `post_count`, `comment_count`, `commented_count`, `follower_count`, `following_count` FROM `user_counters` WHERE `user_id` = ?", uid)
+	if err == sql.ErrNoRows {
+		return c, nil
+	}
+	return c, err
+}
+
+func getPostCommentCounts(pids []int) (map[int]int, error) {
+	counts := make(map[int]int)
+	if len(pids) == 0 {
+		return counts, nil
+	}
+	q, vs, err := sqlx.In("SELECT `post_id`, `comment_count` FROM `post_counters` WHERE `post_id` IN (?)", pids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		PostID       int `db:"post_id"`
+		CommentCount int `db:"comment_count"`
+	}{}
+	if err := db.Select(&rows, q, vs...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		counts[r.PostID] = r.CommentCount
+	}
+	return counts, nil
+}
+
+// runReconcile はカウンタを数え直す。-save-seed を付けると、その値を /initialize で戻す初期データのカウンタにする
+// (初期データを入れた直後か /initialize の直後に動かす)
+func runReconcile(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	saveSeed := fs.Bool("save-seed", false, "save the reconciled counters as the seed restored by /initialize")
+	fs.Parse(args)
+
+	db = openDB()
+	defer db.Close()
+
+	if err := ensureCounterSchema(); err != nil {
+		log.Fatalf("Failed to create counter tables: %s", err.Error())
+	}
+	if err := ensureModerationSchema(); err != nil {
+		log.Fatalf("Failed to create moderation tables: %s", err.Error())
+	}
+	if err := ensurePostEditSchema(); err != nil {
+		log.Fatalf("Failed to add post columns: %s", err.Error())
+	}
+	if err := ensureCommentEditSchema(); err != nil {
+		log.Fatalf("Failed to create comment edit tables: %s", err.Error())
+	}
+	if err := ensureFollowSchema(); err != nil {
+		log.Fatalf("Failed to create follow tables: %s", err.Error())
+	}
+	if err := ensureLikeSchema(); err != nil {
+		log.Fatalf("Failed to create like tables: %s", err.Error())
+	}
+	if err := reconcileCounters(); err != nil {
+		log.Fatalf("Failed to reconcile counters: %s", err.Error())
+	}
+	if *saveSeed {
+		if err := saveSeedCounters(); err != nil {
+			log.Fatalf("Failed to save seed counters: %s", err.Error())
+		}
+	}
+
+	users, posts := 0, 0
+	db.Get(&users, "SELECT COUNT(*) FROM `user_counters`")
+	db.Get(&posts, "SELECT COUNT(*) FROM `post_counters`")
+	fmt.Printf("reconciled counters of %d users and %d posts\n", users, posts)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// resetCounters は数え直したときと同じ値に戻す
+func TestResetCounters(t *testing.T) {
+	setupIntegration(t)
+
+	if _, err := db.Exec("UPDATE `user_counters` SET `post_count` = `post_count` + 100 WHERE `user_id` = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM `post_counters` WHERE `post_id` = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := resetCounters(); err != nil {
+		t.Fatal(err)
+	}
+	restored := userCounter{}
+	if err := db.Get(&restored, "SELECT `post_count`, `comment_count`, `commented_count`, `follower_count`, `following_count` FROM `user_counters` WHERE `user_id` = 1"); err != nil {
+		t.Fatal(err)
+	}
+	restoredComments := 0
+	if err := db.Get(&restoredComments, "SELECT `comment_count` FROM `post_counters` WHERE `post_id` = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reconcileCounters(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := getUserCounter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != want {
+		t.Errorf("user counter = %+v, want %+v", restored, want)
+	}
+	counts, err := getPostCommentCounts([]int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredComments != counts[1] {
+		t.Errorf("comment count = %d, want %d", restoredComments, counts[1])
+	}
+}
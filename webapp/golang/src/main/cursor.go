@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxPostsPerPage = 100
+
+	mysqlDatetimeFormat = "2006-01-02 15:04:05.999999"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// postCursor は (created_at, id) の組で投稿の並び順上の位置を表す。
+// created_at が同じ投稿があっても id で順序が一意に決まるので、ページ境界で重複や抜けが出ない
+type postCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func (c postCursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parsePostCursor(s string) (postCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return postCursor{}, errInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return postCursor{}, errInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return postCursor{}, errInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id <= 0 {
+		return postCursor{}, errInvalidCursor
+	}
+	return postCursor{CreatedAt: time.Unix(0, nsec), ID: id}, nil
+}
+
+// Cursor はこの投稿より古い投稿を取得するためのカーソルを返す
+func (p Post) Cursor() string {
+	return postCursor{CreatedAt: p.CreatedAt, ID: p.ID}.String()
+}
+
+type postsPage struct {
+	Cursor *postCursor
+	// MaxCreatedAt は従来の max_created_at パラメータ。cursor が無いときだけ使う
+	MaxCreatedAt *time.Time
+	Limit        int
+}
+
+// IsFirst は先頭ページ (キャッシュ済みのタイムラインをそのまま返せるページ) かどうか
+func (pg postsPage) IsFirst() bool {
+	return pg.Cursor == nil && pg.MaxCreatedAt == nil && pg.Limit == postsPerPage
+}
+
+// parsePostsPage はクエリパラメータ cursor, limit, max_created_at を解釈する
+func parsePostsPage(r *http.Request) (postsPage, error) {
+	q := r.URL.Query()
+	pg := postsPage{Limit: postsPerPage}
+
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return pg, &validationError{"limit", "invalid limit"}
+		}
+		if limit > maxPostsPerPage {
+			limit = maxPostsPerPage
+		}
+		pg.Limit = limit
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		c, err := parsePostCursor(s)
+		if err != nil {
+			return pg, &validationError{"cursor", err.Error()}
+		}
+		pg.Cursor = &c
+	} else if s := q.Get("max_created_at"); s != "" {
+		t, err := time.Parse(ISO8601_FORMAT, s)
+		if err != nil {
+			return pg, &validationError{"max_created_at", "invalid max_created_at"}
+		}
+		pg.MaxCreatedAt = &t
+	}
+
+	return pg, nil
+}
+
+// cond はページの位置より古い行の条件を返す。createdAt と id はそれぞれ投稿日時と投稿 ID の列
+func (pg postsPage) cond(createdAt, id string) (string, []interface{}) {
+	if pg.Cursor != nil {
+		t := pg.Cursor.CreatedAt.In(time.Local).Format(mysqlDatetimeFormat)
+		return "(" + createdAt + " < ? OR (" + createdAt + " = ? AND " + id + " < ?))", []interface{}{t, t, pg.Cursor.ID}
+	}
+	if pg.MaxCreatedAt != nil {
+		return createdAt + " <= ?", []interface{}{pg.MaxCreatedAt.In(time.Local).Format(mysqlDatetimeFormat)}
+	}
+	return "", nil
+}
+
+// selectPostsPage は where の条件に合う投稿を新しい順に1ページ分取得する
+func selectPostsPage(where string, args []interface{}, pg postsPage) ([]Post, error) {
+	// モデレーションで非表示にした投稿と削除された投稿はどの一覧にも出さない
+	conds := []string{"`hidden_at` IS NULL AND `deleted_at` IS NULL"}
+	if where != "" {
+		conds = append(conds, where)
+	}
+	if cond, condArgs := pg.cond("`created_at`", "`id`"); cond != "" {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	query := "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE " + strings.Join(conds, " AND ")
+	query += " ORDER BY `created_at` DESC, `id` DESC LIMIT ?"
+	args = append(args, pg.Limit)
+
+	results := []Post{}
+	if err := db.Select(&results, query, args...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// nextCursor は次のページがあり得る場合にそのカーソルを返す。
+// makePosts で BAN 済みユーザーの投稿が除かれても位置がずれないよう、取得した行から求める
+func nextCursor(results []Post, pg postsPage) string {
+	if len(results) < pg.Limit || len(results) == 0 {
+		return ""
+	}
+	return results[len(results)-1].Cursor()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zenazn/goji/web"
+)
+
+// timelines はフォローしているユーザーの投稿を投稿時に書き込んでおくホームタイムライン (fan-out on write)。
+// 投稿は posts.fanned_out = 0 で作り、timelines に書き込めたら 1 にする。
+// フォロワーが fanoutFollowerLimit 人を超えるユーザーの投稿や書き込みに失敗した投稿は 0 のまま残り、読むときに follows から引く。
+// どちらで読むかは投稿ごとに決まるので、後でフォロワーの数が変わっても消えない
+var followSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `follows` (" +
+		"`follower_id` int NOT NULL," +
+		"`followee_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`follower_id`, `followee_id`)," +
+		"KEY `idx_followee_id` (`followee_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `timelines` (" +
+		"`user_id` int NOT NULL," +
+		"`post_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `post_id`)," +
+		"KEY `idx_user_id_created_at` (`user_id`, `created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	fanoutFollowerLimit = 1000
+	// フォローしたときにタイムラインへ入れる相手の過去の投稿数
+	followBackfillPosts = 100
+
+	indexTabHome = "home"
+)
+
+func ensureFollowSchema() error {
+	for _, q := range followSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	if err := addColumnIfNotExists("user_counters", "follower_count", "int NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfNotExists("user_counters", "following_count", "int NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// 既存の投稿は timelines に書き込み済みか、フォローしたときに書き込むものとして扱う
+	if err := addColumnIfNotExists("posts", "fanned_out", "tinyint NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	// 自分自身と timelines に書き込まなかった投稿を読むときに使う
+	if err := addIndexIfNotExists("posts", "idx_user_id_created_at", "INDEX `idx_user_id_created_at` (`user_id`, `created_at`)"); err != nil {
+		return err
+	}
+	return addIndexIfNotExists("posts", "idx_user_id_fanned_out", "INDEX `idx_user_id_fanned_out` (`user_id`, `fanned_out`, `created_at`)")
+}
+
+// fanoutPost は p をフォロワーのタイムラインに書き込んで fanned_out にする。
+// フォロワーが多ければ書き込まない。書き込まなかったときや失敗したときは読むときに引くので、投稿は消えない
+func fanoutPost(p Post) error {
+	c, err := getUserCounter(p.UserID)
+	if err != nil {
+		return err
+	}
+	if c.FollowerCount > fanoutFollowerLimit {
+		return nil
+	}
+	_, err = db.Exec("INSERT IGNORE INTO `timelines` (`user_id`, `post_id`, `created_at`) SELECT `follower_id`, ?, ? FROM `follows` WHERE `followee_id` = ?",
+		p.ID, p.CreatedAt, p.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE `posts` SET `fanned_out` = 1 WHERE `id` = ?", p.ID)
+	return err
+}
+
+// selectHomeTimeline は uid のユーザー自身とフォローしているユーザーの投稿を1ページ分取得する。
+// timelines に書き込まれた分と、読むときに引く自分自身の投稿と fanned_out でない投稿をそれぞれ1ページ読んで合わせる
+func selectHomeTimeline(uid int, pg postsPage) ([]Post, error) {
+	authors := []int{}
+	err := db.Select(&authors, "SELECT f.`followee_id` FROM `follows` f WHERE f.`follower_id` = ? "+
+		"AND EXISTS (SELECT 1 FROM `posts` p WHERE p.`user_id` = f.`followee_id` AND p.`fanned_out` = 0)", uid)
+	if err != nil {
+		return nil, err
+	}
+	where, args := activeUserPostsCond+" AND `user_id` = ?", []interface{}{uid}
+	if len(authors) > 0 {
+		where, args, err = sqlx.In(activeUserPostsCond+" AND (`user_id` = ? OR (`user_id` IN (?) AND `fanned_out` = 0))", uid, authors)
+		if err != nil {
+			return nil, err
+		}
+	}
+	onRead, err := selectPostsPage(where, args, pg)
+	if err != nil {
+		return nil, err
+	}
+
+	fannedOut, err := selectTimelinePosts(uid, pg)
+	if err != nil {
+		return nil, err
+	}
+
+	results := onRead
+	seen := map[int]bool{}
+	for _, p := range onRead {
+		seen[p.ID] = true
+	}
+	for _, p := range fannedOut {
+		if !seen[p.ID] {
+			results = append(results, p)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].CreatedAt.Equal(results[j].CreatedAt) {
+			return results[i].CreatedAt.After(results[j].CreatedAt)
+		}
+		return results[i].ID > results[j].ID
+	})
+	if len(results) > pg.Limit {
+		results = results[:pg.Limit]
+	}
+	return results, nil
+}
+
+// 非表示・削除された投稿で1ページに足りないときに timelines を読み足す回数の上限
+const timelineReadRounds = 5
+
+// selectTimelinePosts は uid の timelines から1ページ分の投稿 ID を (user_id, created_at) の索引で読み、投稿を読み込む。
+// 非表示・削除された投稿と BAN されたユーザーの投稿は除き、その分は続きから読み足す
+func selectTimelinePosts(uid int, pg postsPage) ([]Post, error) {
+	posts := []Post{}
+	for i := 0; i < timelineReadRounds && len(posts) < pg.Limit; i++ {
+		query := "SELECT `post_id`, `created_at` FROM `timelines` WHERE `user_id` = ?"
+		args := []interface{}{uid}
+		if cond, condArgs := pg.cond("`created_at`", "`post_id`"); cond != "" {
+			query += " AND " + cond
+			args = append(args, condArgs...)
+		}
+		query += " ORDER BY `created_at` DESC, `post_id` DESC LIMIT ?"
+		args = append(args, pg.Limit)
+		entries := []struct {
+			PostID    int       `db:"post_id"`
+			CreatedAt time.Time `db:"created_at"`
+		}{}
+		if err := db.Select(&entries, query, args...); err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		pids := make([]int, 0, len(entries))
+		for _, e := range entries {
+			pids = append(pids, e.PostID)
+		}
+		q, vs, err := sqlx.In("SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `id` IN (?) "+
+			"AND `hidden_at` IS NULL AND `deleted_at` IS NULL AND "+activeUserPostsCond, pids)
+		if err != nil {
+			return nil, err
+		}
+		found := []Post{}
+		if err := db.Select(&found, q, vs...); err != nil {
+			return nil, err
+		}
+		byID := make(map[int]Post, len(found))
+		for _, p := range found {
+			byID[p.ID] = p
+		}
+		for _, e := range entries {
+			if p, ok := byID[e.PostID]; ok {
+				posts = append(posts, p)
+			}
+		}
+
+		if len(entries) < pg.Limit {
+			break
+		}
+		last := entries[len(entries)-1]
+		pg.Cursor = &postCursor{CreatedAt: last.CreatedAt, ID: last.PostID}
+	}
+	return posts, nil
+}
+
+func isFollowing(followerID, followeeID int) (bool, error) {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	return n > 0, err
+}
+
+// followUser は既にフォローしていれば何もせず false を返す
+func followUser(followerID, followeeID int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("INSERT IGNORE INTO `follows` (`follower_id`, `followee_id`) VALUES (?,?)", followerID, followeeID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if err := addFollowCounters(tx, followerID, followeeID, 1); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	_, err = tx.Exec("INSERT IGNORE INTO `timelines` (`user_id`, `post_id`, `created_at`) "+
+		"SELECT ?, `id`, `created_at` FROM `posts` WHERE `user_id` = ? AND `hidden_at` IS NULL AND `deleted_at` IS NULL ORDER BY `created_at` DESC LIMIT ?",
+		followerID, followeeID, followBackfillPosts)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func unfollowUser(followerID, followeeID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return nil
+	}
+	if err := addFollowCounters(tx, followerID, followeeID, -1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE t FROM `timelines` t JOIN `posts` p ON p.`id` = t.`post_id` WHERE t.`user_id` = ? AND p.`user_id` = ?", followerID, followeeID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func postAccountNameFollow(c web.C, w http.ResponseWriter, r *http.Request) {
+	handleFollow(c, w, r, true)
+}
+
+func postAccountNameUnfollow(c web.C, w http.ResponseWriter, r *http.Request) {
+	handleFollow(c, w, r, false)
+}
+
+func handleFollow(c web.C, w http.ResponseWriter, r *http.Request, follow bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", c.URLParams["accountName"])
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if user.ID == me.ID {
+		redirectWithNotice(w, r, "/@"+user.AccountName, "自分自身はフォローできません")
+		return
+	}
+
+	if follow {
+		filter, err := getUserFilter(me.ID)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if filter.Blocked[user.ID] || filter.BlockedBy[user.ID] {
+			redirectWithNotice(w, r, "/@"+user.AccountName, "このユーザーはフォローできません")
+			return
+		}
+		followed, err := followUser(me.ID, user.ID)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if followed {
+			enqueueNotifications(notification{UserID: user.ID, Type: notificationFollow, ActorID: me.ID})
+		}
+	} else if err := unfollowUser(me.ID, user.ID); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/@"+user.AccountName, http.StatusFound)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func readHomeTimeline(t *testing.T, uid, limit int) []int {
+	pg := postsPage{Limit: limit}
+	ids := []int{}
+	for i := 0; i < 10; i++ {
+		posts, err := selectHomeTimeline(uid, pg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range posts {
+			ids = append(ids, p.ID)
+		}
+		next := nextCursor(posts, pg)
+		if next == "" {
+			return ids
+		}
+		c, err := parsePostCursor(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg.Cursor = &c
+	}
+	t.Fatal("too many pages")
+	return nil
+}
+
+// ホームタイムラインは timelines に書き込まれた投稿と、読むときに引く自分自身とフォロワーの多いユーザーの投稿を合わせる
+func TestHomeTimeline(t *testing.T) {
+	setupIntegration(t)
+
+	me := createTestUser(t, "reader")
+	friend := createTestUser(t, "friend")
+	celeb := createTestUser(t, "celeb")
+	stranger := createTestUser(t, "stranger")
+	_, err := db.Exec("INSERT INTO `user_counters` (`user_id`, `follower_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `follower_count` = VALUES(`follower_count`)",
+		celeb.ID, fanoutFollowerLimit+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []User{friend, celeb} {
+		if _, err := followUser(me.ID, u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(u User, hidden bool) int {
+		p := createTestPost(t, u.ID, "timeline")
+		if err := fanoutPost(p); err != nil {
+			t.Fatal(err)
+		}
+		if hidden {
+			if _, err := db.Exec("UPDATE `posts` SET `hidden_at` = NOW() WHERE `id` = ?", p.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return p.ID
+	}
+	post(stranger, false)
+	f1 := post(friend, false)
+	post(friend, true)
+	post(friend, true)
+	m1 := post(me, false)
+	c1 := post(celeb, false)
+	f4 := post(friend, false)
+
+	// 1ページ目では非表示の投稿の分を timelines から読み足す
+	if got, want := readHomeTimeline(t, me.ID, 2), []int{f4, c1, m1, f1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("home timeline = %v, want %v", got, want)
+	}
+	if got, want := readHomeTimeline(t, me.ID, 20), []int{f4, c1, m1, f1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("home timeline (limit 20) = %v, want %v", got, want)
+	}
+
+	if err := unfollowUser(me.ID, friend.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readHomeTimeline(t, me.ID, 2), []int{c1, m1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after unfollow: home timeline = %v, want %v", got, want)
+	}
+}
+
+// timelines に書き込むかどうかは投稿ごとに決まるので、フォロワーの数が上限をまたいでも投稿は消えない
+func TestHomeTimelineFollowerLimit(t *testing.T) {
+	setupIntegration(t)
+
+	me := createTestUser(t, "fan")
+	author := createTestUser(t, "rising")
+	if _, err := followUser(me.ID, author.ID); err != nil {
+		t.Fatal(err)
+	}
+	setFollowers := func(n int) {
+		if _, err := db.Exec("UPDATE `user_counters` SET `follower_count` = ? WHERE `user_id` = ?", n, author.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func() int {
+		p := createTestPost(t, author.ID, "limit")
+		if err := fanoutPost(p); err != nil {
+			t.Fatal(err)
+		}
+		return p.ID
+	}
+
+	setFollowers(fanoutFollowerLimit + 1)
+	above := post()
+	setFollowers(fanoutFollowerLimit)
+	below := post()
+	setFollowers(fanoutFollowerLimit + 1)
+	aboveAgain := post()
+	setFollowers(fanoutFollowerLimit)
+	// fan-out に失敗した投稿も fanned_out = 0 のまま読むときに引く
+	pending := createTestPost(t, author.ID, "limit").ID
+
+	if got, want := readHomeTimeline(t, me.ID, 2), []int{pending, aboveAgain, below, above}; !reflect.DeepEqual(got, want) {
+		t.Errorf("home timeline = %v, want %v", got, want)
+	}
+	for pid, want := range map[int]int{above: 0, below: 1, aboveAgain: 0, pending: 0} {
+		fannedOut := 0
+		if err := db.Get(&fannedOut, "SELECT `fanned_out` FROM `posts` WHERE `id` = ?", pid); err != nil {
+			t.Fatal(err)
+		}
+		if fannedOut != want {
+			t.Errorf("post %d: fanned_out = %d, want %d", pid, fannedOut, want)
+		}
+	}
+}
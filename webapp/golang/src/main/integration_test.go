@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 統合テストは ISUCONP_TEST_INTEGRATION=1 のときだけ動かす。
+// 初期データを入れた MySQL (接続先は ISUCONP_DB_* ) と memcached が必要で、dbInitialize でデータを初期化する。
+// memcached の接続先は ISUCONP_MEMCACHED_ADDRESS (既定は /tmp/memcached.sock)
+var (
+	integrationOnce sync.Once
+	integrationErr  error
+)
+
+func setupIntegration(tb testing.TB) {
+	if os.Getenv("ISUCONP_TEST_INTEGRATION") != "1" {
+		tb.Skip("set ISUCONP_TEST_INTEGRATION=1 to run integration tests")
+	}
+	integrationOnce.Do(func() {
+		integrationErr = startIntegration()
+	})
+	if integrationErr != nil {
+		tb.Fatal(integrationErr)
+	}
+}
+
+func startIntegration() error {
+	upstream := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
+	if upstream == "" {
+		upstream = "/tmp/memcached.sock"
+	}
+	addr, err := startMemcacheProxy(upstream)
+	if err != nil {
+		return err
+	}
+	os.Setenv("ISUCONP_MEMCACHED_ADDRESS", addr)
+	initServer()
+
+	sql.Register("mysql-counting", countingDriver{})
+	db, err = sqlx.Open("mysql-counting", mysqlDSN())
+	if err != nil {
+		return err
+	}
+	if err = db.Ping(); err != nil {
+		return err
+	}
+
+	ensures := []func() error{
+		ensureCounterSchema,
+		ensureBanSchema,
+		ensureAuditSchema,
+		ensureRoleSchema,
+		ensureModerationSchema,
+		ensurePostEditSchema,
+		ensureCommentEditSchema,
+		ensureTagSchema,
+		ensureMentionSchema,
+		ensureNotificationSchema,
+		ensureFollowSchema,
+		ensureLikeSchema,
+		ensureBlockSchema,
+	}
+	for _, ensure := range ensures {
+		if err = ensure(); err != nil {
+			return err
+		}
+	}
+	go writeNotifications()
+	if err = createSearchIndexes(); err != nil {
+		return err
+	}
+	if err = setupSearcher(); err != nil {
+		return err
+	}
+	dbInitialize()
+	registerRoutes()
+	return nil
+}
+
+// roundTrips はテスト中に DB と memcache に送ったコマンドを記録する
+var roundTrips = &roundTripLog{}
+
+type roundTripLog struct {
+	mu       sync.Mutex
+	queries  []string
+	memcache []string
+}
+
+func (l *roundTripLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = nil
+	l.memcache = nil
+}
+
+func (l *roundTripLog) addQuery(q string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, q)
+}
+
+func (l *roundTripLog) addMemcache(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.memcache = append(l.memcache, line)
+}
+
+// countQueries は match を満たすクエリの数を返す
+func (l *roundTripLog) countQueries(match func(q string) bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, q := range l.queries {
+		if match(q) {
+			n++
+		}
+	}
+	return n
+}
+
+// countGets は最初のキーが keyPrefix で始まる get/gets コマンドの数を返す。GetMulti 1回は1コマンドになる
+func (l *roundTripLog) countGets(keyPrefix string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, line := range l.memcache {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "get" && fields[0] != "gets") {
+			continue
+		}
+		if strings.HasPrefix(fields[1], keyPrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// countingDriver は go-sql-driver/mysql に送るクエリを roundTrips に記録する
+type countingDriver struct {
+	mysql.MySQLDriver
+}
+
+func (d countingDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.MySQLDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	roundTrips.addQuery(query)
+	return c.Conn.Prepare(query)
+}
+
+// 引数付きのクエリは ErrSkip が返って Prepare に回るので、そのときは数えない
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		roundTrips.addQuery(query)
+	}
+	return rows, err
+}
+
+// startMemcacheProxy は memcached との間に入ってコマンド行を roundTrips に記録するプロキシを立てる
+func startMemcacheProxy(upstream string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(upstream, "/") {
+		network = "unix"
+	}
+	conn, err := net.Dial(network, upstream)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial(network, upstream)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() {
+				io.Copy(client, server)
+				client.Close()
+			}()
+			go proxyMemcacheCommands(client, server)
+		}
+	}()
+	return l.Addr().String(), nil
+}
+
+func proxyMemcacheCommands(client, server net.Conn) {
+	defer server.Close()
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		roundTrips.addMemcache(strings.TrimSpace(line))
+		if _, err = io.WriteString(server, line); err != nil {
+			return
+		}
+		// 保存系のコマンドは続くデータブロックをそのまま流す
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		switch fields[0] {
+		case "set", "add", "replace", "append", "prepend", "cas":
+			n, err := strconv.Atoi(fields[4])
+			if err != nil {
+				return
+			}
+			if _, err = io.CopyN(server, r, int64(n+2)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// purgeLocalCaches はプロセス内キャッシュを捨てて、次の読み込みを memcache に向ける
+func purgeLocalCaches() {
+	for _, c := range tieredCaches {
+		c.local.purge()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// 書き込み処理はキャッシュを直接触らず、何が変わったかをイベントとして publishInvalidation する。
+// 各キャッシュは subscribeInvalidation で自分に関係するイベントを受け取って更新・破棄する
+
+// userBanned は UserIDs のユーザーが BAN されたことを表す
+type userBanned struct {
+	UserIDs []int
+}
+
+// userUnbanned は UserIDs のユーザーの BAN が解除されたことを表す
+type userUnbanned struct {
+	UserIDs []int
+}
+
+// userRolesChanged は UserID のユーザーのロールが変わったことを表す
+type userRolesChanged struct {
+	UserID int
+}
+
+// postUpdated は Post の本文が編集されたことを表す
+type postUpdated struct {
+	Post Post
+}
+
+// postDeleted は PostID の投稿が投稿者によって削除されたことを表す
+type postDeleted struct {
+	PostID int
+}
+
+// postHidden は PostID の投稿がモデレーションで非表示になったことを表す
+type postHidden struct {
+	PostID int
+}
+
+// commentHidden は PostID の投稿への CommentID のコメントがモデレーションで非表示になったことを表す
+type commentHidden struct {
+	PostID    int
+	CommentID int
+}
+
+// commentUpdated は Comment が編集されたことを表す
+type commentUpdated struct {
+	Comment Comment
+}
+
+// commentDeleted は PostID の投稿への CommentID のコメントが削除されたことを表す
+type commentDeleted struct {
+	PostID    int
+	CommentID int
+}
+
+// userRegistered は User が登録されたことを表す
+type userRegistered struct {
+	User User
+}
+
+// postCreated は Post が投稿されたことを表す
+type postCreated struct {
+	Post Post
+}
+
+// commentCreated は Comment がコメントされたことを表す
+type commentCreated struct {
+	Comment Comment
+}
+
+// userFilterChanged は UserIDs のユーザーのブロック・ミュートの関係が変わったことを表す
+type userFilterChanged struct {
+	UserIDs []int
+}
+
+type invalidationHandler func(ev interface{})
+
+var (
+	invalidationMu       sync.RWMutex
+	invalidationHandlers []invalidationHandler
+)
+
+func subscribeInvalidation(h invalidationHandler) {
+	invalidationMu.Lock()
+	defer invalidationMu.Unlock()
+	invalidationHandlers = append(invalidationHandlers, h)
+}
+
+// publishInvalidation は購読しているハンドラを同期的に呼び出す。
+// 返ったときにはキャッシュが更新済みなので、直後のリダイレクト先で古い値は見えない
+func publishInvalidation(ev interface{}) {
+	invalidationMu.RLock()
+	handlers := invalidationHandlers
+	invalidationMu.RUnlock()
+	for _, h := range handlers {
+		h(ev)
+	}
+}
+
+func init() {
+	subscribeInvalidation(userCacheHandler)
+	subscribeInvalidation(indexPostsCacheHandler)
+	subscribeInvalidation(commentCacheHandler)
+	subscribeInvalidation(userFilterCacheHandler)
+}
+
+func userCacheHandler(ev interface{}) {
+	switch ev := ev.(type) {
+	case userBanned:
+		for _, uid := range ev.UserIDs {
+			setUserDelFlgOnCache(uid, 1)
+		}
+	case userUnbanned:
+		for _, uid := range ev.UserIDs {
+			setUserDelFlgOnCache(uid, 0)
+		}
+	case userRegistered:
+		setUserOnCache(ev.User)
+	case userRolesChanged:
+		reloadUserOnCache(ev.UserID)
+	}
+}
+
+func indexPostsCacheHandler(ev interface{}) {
+	switch ev := ev.(type) {
+	case userBanned, userUnbanned:
+		// BAN や解除したユーザーの投稿の表示がすぐに変わるよう、一覧を作り直す
+		rebuildIndexPosts()
+	case postCreated:
+		prependIndexPost(ev.Post)
+	case postUpdated:
+		updateIndexPost(ev.Post)
+	case postHidden, postDeleted:
+		rebuildIndexPosts()
+	}
+}
+
+func commentCacheHandler(ev interface{}) {
+	switch ev := ev.(type) {
+	case commentCreated:
+		if err := appendCommentOnCache(ev.Comment); err != nil {
+			fmt.Printf("error append comment on cache (ID: %d): %s\n", ev.Comment.ID, err.Error())
+		}
+	case commentHidden:
+		reloadCommentsOnCache(ev.PostID)
+	case commentUpdated:
+		if err := updateCommentOnCache(ev.Comment); err != nil {
+			fmt.Printf("error update comment on cache (ID: %d): %s\n", ev.Comment.ID, err.Error())
+		}
+		commentCache.evict(getCommentsCacheKey(ev.Comment.PostID))
+	case commentDeleted:
+		if err := removeCommentOnCache(ev.PostID, ev.CommentID); err != nil {
+			fmt.Printf("error remove comment on cache (ID: %d): %s\n", ev.CommentID, err.Error())
+		}
+		commentCache.evict(getCommentsCacheKey(ev.PostID))
+	case postDeleted:
+		// 削除された投稿のコメントはもう読まれない
+		memcacheClient.Delete(getCommentsCacheKey(ev.PostID))
+		commentCache.evict(getCommentsCacheKey(ev.PostID))
+	}
+}
+
+func userFilterCacheHandler(ev interface{}) {
+	switch ev := ev.(type) {
+	case userFilterChanged:
+		for _, uid := range ev.UserIDs {
+			reloadUserFilterOnCache(uid)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+	"github.com/zenazn/goji/web"
+)
+
+// いいねの数は post_counters.like_count に持ち、表示用には memcache に置く。
+// いいねが変わったら DB から読み直して casReplace で置き換える
+var likeSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `likes` (" +
+		"`user_id` int NOT NULL," +
+		"`post_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `post_id`)," +
+		"KEY `idx_post_id_created_at` (`post_id`, `created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const postLikersLimit = 20
+
+var likeCountCachePolicy = cachePolicy{ttl: 10 * time.Minute}
+
+func ensureLikeSchema() error {
+	for _, q := range likeSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return addColumnIfNotExists("post_counters", "like_count", "int NOT NULL DEFAULT 0")
+}
+
+func getLikeCountCacheKey(pid int) string {
+	return "like_count:" + strconv.Itoa(pid)
+}
+
+// getPostLikeCounts は memcache にない投稿のいいね数だけ post_counters から読んで memcache に置く
+func getPostLikeCounts(pids []int) (map[int]int, error) {
+	counts := make(map[int]int)
+	if len(pids) == 0 {
+		return counts, nil
+	}
+
+	keys := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		keys = append(keys, getLikeCountCacheKey(pid))
+	}
+	items, err := memcacheClient.GetMulti(keys)
+	if err != nil {
+		fmt.Println(err)
+		items = map[string]*memcache.Item{}
+	}
+
+	misses := []int{}
+	for _, pid := range pids {
+		it, ok := items[getLikeCountCacheKey(pid)]
+		if !ok {
+			misses = append(misses, pid)
+			continue
+		}
+		v, err := unwrapCacheValue(it.Value)
+		n := 0
+		if err == nil {
+			n, err = strconv.Atoi(string(v.payload))
+		}
+		if err != nil {
+			misses = append(misses, pid)
+			continue
+		}
+		counts[pid] = n
+	}
+	if len(misses) == 0 {
+		return counts, nil
+	}
+
+	q, vs, err := sqlx.In("SELECT `post_id`, `like_count` FROM `post_counters` WHERE `post_id` IN (?)", misses)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		PostID    int `db:"post_id"`
+		LikeCount int `db:"like_count"`
+	}{}
+	start := time.Now()
+	if err := db.Select(&rows, q, vs...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		counts[r.PostID] = r.LikeCount
+	}
+	// 読んでいる間にいいねが変わっていたら casReplace が先に置いているので、Add は失敗して古い値を置かない
+	delta := time.Since(start)
+	for _, pid := range misses {
+		memcacheClient.Add(likeCountCachePolicy.item(getLikeCountCacheKey(pid), []byte(strconv.Itoa(counts[pid])), delta))
+	}
+	return counts, nil
+}
+
+// getLikedPostIDs は pids のうち uid のユーザーがいいねしている投稿を返す
+func getLikedPostIDs(uid int, pids []int) (map[int]bool, error) {
+	liked := make(map[int]bool)
+	if uid == 0 || len(pids) == 0 {
+		return liked, nil
+	}
+	q, vs, err := sqlx.In("SELECT `post_id` FROM `likes` WHERE `user_id` = ? AND `post_id` IN (?)", uid, pids)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	if err := db.Select(&ids, q, vs...); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		liked[id] = true
+	}
+	return liked, nil
+}
+
+// setLike は uid のユーザーの pid の投稿へのいいねを liked にする。状態が変わったときだけ true を返す
+func setLike(uid, pid int, liked bool) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	var res sql.Result
+	delta := 1
+	if liked {
+		res, err = tx.Exec("INSERT IGNORE INTO `likes` (`user_id`, `post_id`) VALUES (?,?)", uid, pid)
+	} else {
+		res, err = tx.Exec("DELETE FROM `likes` WHERE `user_id` = ? AND `post_id` = ?", uid, pid)
+		delta = -1
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if _, err := tx.Exec("INSERT INTO `post_counters` (`post_id`, `like_count`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `like_count` = `like_count` + VALUES(`like_count`)", pid, delta); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	reloadLikeCountOnCache(pid)
+	return true, nil
+}
+
+// reloadLikeCountOnCache はコミットした後のいいね数を DB から読んで memcache に置く。
+// memcache に無いときも Add で置くので、その前に DB を読んだ読み手の Add は失敗する
+func reloadLikeCountOnCache(pid int) {
+	err := casReplace(getLikeCountCacheKey(pid), likeCountCachePolicy, func() ([]byte, error) {
+		n := 0
+		err := db.Get(&n, "SELECT `like_count` FROM `post_counters` WHERE `post_id` = ?", pid)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(n)), nil
+	})
+	if err != nil {
+		fmt.Printf("error reload like count on cache (ID: %d): %s\n", pid, err.Error())
+		memcacheClient.Delete(getLikeCountCacheKey(pid))
+	}
+}
+
+// getPostLikers は pid の投稿にいいねしたユーザーを新しい順に返す
+func getPostLikers(pid int) ([]User, error) {
+	users := []User{}
+	err := db.Select(&users, "SELECT u.`id`, u.`account_name` FROM `likes` l JOIN `users` u ON u.`id` = l.`user_id` "+
+		"WHERE l.`post_id` = ? AND u.`del_flg` = 0 ORDER BY l.`created_at` DESC LIMIT ?", pid, postLikersLimit)
+	return users, err
+}
+
+// resetLikes は初期化でいいねを消し、memcache に残ったいいね数も消す
+func resetLikes() error {
+	pids := []int{}
+	if err := db.Select(&pids, "SELECT DISTINCT `post_id` FROM `likes`"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM `likes`"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE `post_counters` SET `like_count` = 0 WHERE `like_count` != 0"); err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		memcacheClient.Delete(getLikeCountCacheKey(pid))
+	}
+	return nil
+}
+
+// postPostsIDLike は action=unlike ならいいねを取り消し、それ以外ならいいねする。何度送っても結果は同じ
+func postPostsIDLike(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(c.URLParams["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	n := 0
+	if err := db.Get(&n, "SELECT COUNT(*) FROM `posts` WHERE `id` = ? AND `hidden_at` IS NULL AND `deleted_at` IS NULL", pid); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	liked := r.FormValue("action") != "unlike"
+	changed, err := setLike(me.ID, pid, liked)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if changed && liked {
+		enqueueNotifications(notification{Type: notificationLike, ActorID: me.ID, PostID: pid})
+	}
+
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
+}
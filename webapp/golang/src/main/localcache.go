@@ -0,0 +1,305 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// lruCache はサイズ上限と TTL 付きのプロセス内キャッシュ。
+// 値はデコード済みのものを共有するので、取り出した側で書き換えてはいけない
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	gen     uint64
+	expires time.Time
+	// removed は remove で残した墓標で、seq はそのときの通し番号
+	removed bool
+	seq     uint64
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key string, gen uint64) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	expired := time.Now().After(e.expires)
+	if e.removed && !expired {
+		return nil, false
+	}
+	if e.removed || e.gen != gen || expired {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache) set(key string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(&lruEntry{key: key, value: value, gen: gen, expires: time.Now().Add(c.ttl)})
+}
+
+// setSince は seq より後に remove されていなければ set する
+func (c *lruCache) setSince(key string, value interface{}, gen, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		if e := el.Value.(*lruEntry); e.removed && e.seq > seq {
+			return
+		}
+	}
+	c.put(&lruEntry{key: key, value: value, gen: gen, expires: time.Now().Add(c.ttl)})
+}
+
+// remove は key を捨てる。remove より前に読み始めた古い値が後から setSince されないよう墓標を残す
+func (c *lruCache) remove(key string, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(&lruEntry{key: key, removed: true, seq: seq, expires: time.Now().Add(c.ttl)})
+}
+
+func (c *lruCache) put(e *lruEntry) {
+	key := e.key
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.capacity {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+var cacheStats = expvar.NewMap("cache")
+
+// tieredCache は memcache の手前に置くプロセス内キャッシュの名前空間。
+// 書き込み側は invalidate で memcache 上の世代番号を進め、他のアプリケーションサーバーは
+// watchCacheGenerations でそれを検知して自分のプロセス内キャッシュを捨てる。
+// 1つのキーだけを捨てるときは evict を使い、memcache 上の削除ログで他のサーバーに知らせる
+type tieredCache struct {
+	ns    string
+	local *lruCache
+	gen   uint64
+	seq   uint64
+	// evicted は削除ログをどこまで取り込んだか。watchCacheGenerations だけが触る
+	evicted uint64
+}
+
+// cacheToken は読み込みを始めた時点の世代番号と evict の通し番号
+type cacheToken struct {
+	gen uint64
+	seq uint64
+}
+
+func newTieredCache(ns string, capacity int, ttl time.Duration) *tieredCache {
+	c := &tieredCache{ns: ns, local: newLRUCache(capacity, ttl)}
+	tieredCaches = append(tieredCaches, c)
+	return c
+}
+
+var tieredCaches []*tieredCache
+
+var (
+	userCache       = newTieredCache("user", 2000, 30*time.Second)
+	commentCache    = newTieredCache("comments", 20000, 10*time.Second)
+	indexPostsCache = newTieredCache("indexPosts", 1, 10*time.Second)
+)
+
+func (c *tieredCache) generationKey() string {
+	return "gen:" + c.ns
+}
+
+func (c *tieredCache) evictionSeqKey() string {
+	return "evict:" + c.ns
+}
+
+func (c *tieredCache) evictionKey(seq uint64) string {
+	return "evict:" + c.ns + ":" + strconv.FormatUint(seq, 10)
+}
+
+// generation は memcache を読む前に取得しておき、set に渡す。
+// 読んでいる間に invalidate や evict された場合、古い値はプロセス内キャッシュに残らない
+func (c *tieredCache) generation() cacheToken {
+	return cacheToken{gen: atomic.LoadUint64(&c.gen), seq: atomic.LoadUint64(&c.seq)}
+}
+
+func (c *tieredCache) get(key string) (interface{}, bool) {
+	v, ok := c.local.get(key, atomic.LoadUint64(&c.gen))
+	if ok {
+		cacheStats.Add(c.ns+".local.hit", 1)
+	} else {
+		cacheStats.Add(c.ns+".local.miss", 1)
+	}
+	return v, ok
+}
+
+func (c *tieredCache) set(key string, value interface{}, t cacheToken) {
+	c.local.setSince(key, value, t.gen, t.seq)
+}
+
+// countRemote は memcache 側のヒット数・ミス数を記録する
+func (c *tieredCache) countRemote(hits, misses int) {
+	cacheStats.Add(c.ns+".memcache.hit", int64(hits))
+	cacheStats.Add(c.ns+".memcache.miss", int64(misses))
+}
+
+// invalidate はこのプロセスのキャッシュを捨て、世代番号を進めて他のプロセスにも知らせる
+func (c *tieredCache) invalidate() {
+	gen, err := incrementCounter(c.generationKey())
+	if err != nil {
+		fmt.Printf("error bumping cache generation (%s): %s\n", c.ns, err.Error())
+		c.local.purge()
+		return
+	}
+	c.setGeneration(gen)
+	cacheStats.Add(c.ns+".invalidate", 1)
+}
+
+func (c *tieredCache) setGeneration(gen uint64) {
+	if atomic.SwapUint64(&c.gen, gen) != gen {
+		c.local.purge()
+	}
+}
+
+// evict はこのプロセスのキャッシュから key を捨て、削除ログに書いて他のプロセスにも知らせる。
+// invalidate と違って同じ名前空間の他のキーは残る
+func (c *tieredCache) evict(key string) {
+	c.remove(key)
+	seq, err := incrementCounter(c.evictionSeqKey())
+	if err == nil {
+		err = memcacheClient.Set(&memcache.Item{Key: c.evictionKey(seq), Value: []byte(key), Expiration: evictionLogTTL})
+	}
+	if err != nil {
+		// 他のプロセスに知らせられないときは名前空間ごと捨てる
+		fmt.Printf("error logging cache eviction (%s): %s\n", key, err.Error())
+		c.invalidate()
+		return
+	}
+	cacheStats.Add(c.ns+".evict", 1)
+}
+
+func (c *tieredCache) remove(key string) {
+	c.local.remove(key, atomic.AddUint64(&c.seq, 1))
+}
+
+const (
+	// 削除ログを残す秒数と、1回に取り込む件数の上限。追いつけないときは名前空間ごと捨てる
+	evictionLogTTL   = 60
+	evictionLogLimit = 1000
+)
+
+// applyEvictions は他のプロセスが evict したキーを削除ログの seq 番まで取り込む
+func (c *tieredCache) applyEvictions(seq uint64) {
+	if seq == c.evicted {
+		return
+	}
+	if seq < c.evicted || seq-c.evicted > evictionLogLimit {
+		c.local.purge()
+		c.evicted = seq
+		return
+	}
+	keys := make([]string, 0, seq-c.evicted)
+	for i := c.evicted + 1; i <= seq; i++ {
+		keys = append(keys, c.evictionKey(i))
+	}
+	items, err := memcacheClient.GetMulti(keys)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			// 期限切れや書き込み途中で読めなかった
+			c.local.purge()
+			break
+		}
+		c.remove(string(item.Value))
+	}
+	c.evicted = seq
+}
+
+// incrementCounter は memcache 上のカウンタを1つ進めた値を返す。無ければ1から始める
+func incrementCounter(key string) (uint64, error) {
+	n, err := memcacheClient.Increment(key, 1)
+	if err == memcache.ErrCacheMiss {
+		err = memcacheClient.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		n = 1
+		if err == memcache.ErrNotStored {
+			n, err = memcacheClient.Increment(key, 1)
+		}
+	}
+	return n, err
+}
+
+// watchCacheGenerations は他のプロセスによる invalidate と evict を interval ごとに取り込む。
+// そのためプロセス内キャッシュは最大で interval だけ古い値を返すことがある
+func watchCacheGenerations(interval time.Duration) {
+	keys := make([]string, 0, len(tieredCaches)*2)
+	for _, c := range tieredCaches {
+		keys = append(keys, c.generationKey(), c.evictionSeqKey())
+	}
+	for range time.Tick(interval) {
+		items, err := memcacheClient.GetMulti(keys)
+		if err != nil {
+			continue
+		}
+		for _, c := range tieredCaches {
+			gen := uint64(0)
+			if item, ok := items[c.generationKey()]; ok {
+				gen, _ = strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+			}
+			c.setGeneration(gen)
+			seq := uint64(0)
+			if item, ok := items[c.evictionSeqKey()]; ok {
+				seq, _ = strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+			}
+			c.applyEvictions(seq)
+		}
+	}
+}
+
+// getAdminDebugVars は cacheStats など expvar の値を JSON で返す
+func getAdminDebugVars(w http.ResponseWriter, r *http.Request) {
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheRemove(t *testing.T) {
+	c := newLRUCache(10, time.Minute)
+	c.setSince("a", 1, 0, 0)
+	c.setSince("b", 2, 0, 0)
+
+	c.remove("a", 5)
+	if _, ok := c.get("a", 0); ok {
+		t.Error("removed key is still cached")
+	}
+	if v, ok := c.get("b", 0); !ok || v != 2 {
+		t.Errorf("get(b) = %v, %v; other keys must survive remove", v, ok)
+	}
+
+	// remove より前に読み始めた値は入れない
+	c.setSince("a", 1, 0, 4)
+	if _, ok := c.get("a", 0); ok {
+		t.Error("value read before remove was cached")
+	}
+	c.setSince("a", 3, 0, 5)
+	if v, ok := c.get("a", 0); !ok || v != 3 {
+		t.Errorf("get(a) = %v, %v; want 3, true", v, ok)
+	}
+}
+
+func TestLRUCacheGeneration(t *testing.T) {
+	c := newLRUCache(10, time.Minute)
+	c.set("a", 1, 1)
+	if _, ok := c.get("a", 2); ok {
+		t.Error("value from an old generation was returned")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// mentions は投稿本文・コメント中の @account_name でメンションされたユーザーを保存する
+var mentionSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `mentions` (" +
+		"`source_type` varchar(16) NOT NULL," +
+		"`source_id` int NOT NULL," +
+		"`user_id` int NOT NULL," +
+		"`post_id` int NOT NULL," +
+		"`author_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`source_type`, `source_id`, `user_id`)," +
+		"KEY `idx_user_id` (`user_id`, `created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	mentionSourcePost    = "post"
+	mentionSourceComment = "comment"
+
+	maxMentionsPerText = 10
+)
+
+// accountNameChars は validateUser と同じアカウント名に使える文字
+const accountNameChars = `[0-9a-zA-Z_]`
+
+var (
+	accountNameRegexp = regexp.MustCompile(`\A` + accountNameChars + `{3,}\z`)
+	// 単語の途中の @ (メールアドレスなど) はメンションとみなさない
+	mentionRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@(` + accountNameChars + `{3,})`)
+)
+
+func ensureMentionSchema() error {
+	for _, q := range mentionSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractMentions は本文からアカウント名を出現順に重複なく取り出す
+func extractMentions(text string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionRegexp.FindAllStringSubmatch(text, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		names = append(names, m[1])
+		if len(names) == maxMentionsPerText {
+			break
+		}
+	}
+	return names
+}
+
+type mentionSource struct {
+	Type     string
+	ID       int
+	PostID   int
+	AuthorID int
+}
+
+// setMentions は source のメンションを text から作り直し、新たにメンションされたユーザーへの通知を返す。
+// 編集で同じユーザーへのメンションが残っている場合は通知し直さない。通知はコミット後に enqueueNotifications する
+func setMentions(tx *sqlx.Tx, src mentionSource, text string) ([]notification, error) {
+	before := []int{}
+	if err := tx.Select(&before, "SELECT `user_id` FROM `mentions` WHERE `source_type` = ? AND `source_id` = ?", src.Type, src.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM `mentions` WHERE `source_type` = ? AND `source_id` = ?", src.Type, src.ID); err != nil {
+		return nil, err
+	}
+
+	names := extractMentions(text)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	q, args, err := sqlx.In("SELECT `id` FROM `users` WHERE `account_name` IN (?) AND `del_flg` = 0 AND `id` != ?", names, src.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+	uids := []int{}
+	if err := tx.Select(&uids, q, args...); err != nil {
+		return nil, err
+	}
+
+	ns := []notification{}
+	mentioned := map[int]bool{}
+	for _, uid := range before {
+		mentioned[uid] = true
+	}
+	for _, uid := range uids {
+		if _, err := tx.Exec("INSERT INTO `mentions` (`source_type`, `source_id`, `user_id`, `post_id`, `author_id`) VALUES (?,?,?,?,?)",
+			src.Type, src.ID, uid, src.PostID, src.AuthorID); err != nil {
+			return nil, err
+		}
+		if mentioned[uid] {
+			continue
+		}
+		n := notification{UserID: uid, Type: notificationMention, ActorID: src.AuthorID, PostID: src.PostID}
+		if src.Type == mentionSourceComment {
+			n.CommentID = src.ID
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zenazn/goji/web"
+)
+
+// ユーザーからの通報と、それを処理するモデレーションキュー。
+// 通報は対象 (投稿かコメント) ごとにまとめて処理し、処理するとその対象への未処理の通報がすべて解決済みになる
+var moderationSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `reports` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`reporter_id` int NOT NULL," +
+		"`target_type` varchar(16) NOT NULL," +
+		"`target_id` int NOT NULL," +
+		"`reason` varchar(32) NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`resolved_at` timestamp NULL DEFAULT NULL," +
+		"`resolved_by` int DEFAULT NULL," +
+		"`resolution` varchar(16) DEFAULT NULL," +
+		"UNIQUE KEY `uniq_reporter_target` (`reporter_id`, `target_type`, `target_id`)," +
+		"KEY `idx_target` (`target_type`, `target_id`, `resolved_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	reportTargetPost    = "post"
+	reportTargetComment = "comment"
+)
+
+const (
+	resolutionDismiss = "dismiss"
+	resolutionHide    = "hide"
+	resolutionBan     = "ban"
+)
+
+type reportReason struct {
+	Value string
+	Label string
+}
+
+var reportReasons = []reportReason{
+	{"spam", "スパム"},
+	{"offensive", "不快な内容"},
+	{"other", "その他"},
+}
+
+func reportReasonLabel(reason string) string {
+	for _, rr := range reportReasons {
+		if rr.Value == reason {
+			return rr.Label
+		}
+	}
+	return ""
+}
+
+func ensureModerationSchema() error {
+	for _, q := range moderationSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	// 非表示にした投稿・コメントはどの一覧にも出さない
+	if err := addColumnIfNotExists("posts", "hidden_at", "timestamp NULL DEFAULT NULL"); err != nil {
+		return err
+	}
+	return addColumnIfNotExists("comments", "hidden_at", "timestamp NULL DEFAULT NULL")
+}
+
+// reportTarget は通報された投稿かコメント。AuthorID は投稿者、PostID は表示する投稿
+type reportTarget struct {
+	Type     string
+	ID       int
+	PostID   int
+	AuthorID int
+	Text     string
+	Hidden   bool
+	Deleted  bool
+}
+
+func getReportTarget(targetType string, targetID int) (reportTarget, error) {
+	t := reportTarget{Type: targetType, ID: targetID}
+	row := struct {
+		PostID    int            `db:"post_id"`
+		AuthorID  int            `db:"user_id"`
+		Text      string         `db:"text"`
+		HiddenAt  sql.NullString `db:"hidden_at"`
+		DeletedAt sql.NullString `db:"deleted_at"`
+	}{}
+	var err error
+	switch targetType {
+	case reportTargetPost:
+		err = db.Get(&row, "SELECT `id` AS `post_id`, `user_id`, `body` AS `text`, `hidden_at`, `deleted_at` FROM `posts` WHERE `id` = ?", targetID)
+	case reportTargetComment:
+		err = db.Get(&row, "SELECT `post_id`, `user_id`, `comment` AS `text`, `hidden_at`, `deleted_at` FROM `comments` WHERE `id` = ?", targetID)
+	default:
+		return t, sql.ErrNoRows
+	}
+	if err != nil {
+		return t, err
+	}
+	t.PostID, t.AuthorID, t.Text, t.Hidden, t.Deleted = row.PostID, row.AuthorID, row.Text, row.HiddenAt.Valid, row.DeletedAt.Valid
+	return t, nil
+}
+
+func postReport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reason := r.FormValue("reason")
+	if reportReasonLabel(reason) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t, err := getReportTarget(r.FormValue("target_type"), targetID)
+	if err == sql.ErrNoRows || (err == nil && (t.Hidden || t.Deleted)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// 同じ人が同じ対象を何度通報しても1件として数える
+	_, err = db.Exec("INSERT IGNORE INTO `reports` (`reporter_id`, `target_type`, `target_id`, `reason`) VALUES (?,?,?,?)", me.ID, t.Type, t.ID, reason)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = "通報しました"
+	session.Save(r, w)
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", t.PostID), http.StatusFound)
+}
+
+// reportGroup は同じ対象への未処理の通報をまとめたもの
+type reportGroup struct {
+	TargetType string `db:"target_type"`
+	TargetID   int    `db:"target_id"`
+	Count      int    `db:"cnt"`
+	Reasons    string `db:"reasons"`
+	Target     reportTarget
+	Author     User
+}
+
+func (g reportGroup) ReasonLabels() string {
+	labels := []string{}
+	for _, reason := range strings.Split(g.Reasons, ",") {
+		labels = append(labels, reportReasonLabel(reason))
+	}
+	return strings.Join(labels, ", ")
+}
+
+const reportGroupsPerPage = 50
+
+func getReportGroups() ([]reportGroup, error) {
+	groups := []reportGroup{}
+	err := db.Select(&groups,
+		"SELECT `target_type`, `target_id`, COUNT(*) AS `cnt`, GROUP_CONCAT(DISTINCT `reason` ORDER BY `reason`) AS `reasons` "+
+			"FROM `reports` WHERE `resolved_at` IS NULL GROUP BY `target_type`, `target_id` "+
+			"ORDER BY `cnt` DESC, MIN(`created_at`) LIMIT ?", reportGroupsPerPage)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []int{}
+	for i := range groups {
+		t, err := getReportTarget(groups[i].TargetType, groups[i].TargetID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		groups[i].Target = t
+		uids = append(uids, t.AuthorID)
+	}
+	users, err := getUsers(uids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		groups[i].Author = users[groups[i].Target.AuthorID]
+	}
+	return groups, nil
+}
+
+func getAdminReports(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	groups, err := getReportGroups()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	canBan, err := hasPermission(me, permBanUsers)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("reports.html")),
+	).Execute(w, struct {
+		Groups    []reportGroup
+		CanBan    bool
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{groups, canBan, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminReports(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t, err := getReportTarget(r.FormValue("target_type"), targetID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	actor := newAuditActor(c, r, me)
+	resolution := r.FormValue("action")
+	switch resolution {
+	case resolutionDismiss:
+		err = dismissReports(actor, t)
+	case resolutionHide:
+		err = hideContent(actor, t)
+	case resolutionBan:
+		ok, perr := hasPermission(me, permBanUsers)
+		if perr != nil {
+			fmt.Println(perr)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		err = banReportedAuthor(actor, t)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if notice := banNotice(err); notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+		http.Redirect(w, r, "/admin/reports", http.StatusFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusFound)
+}
+
+// dismissReports は t への通報を問題なしとして解決済みにする
+func dismissReports(actor auditActor, t reportTarget) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err := resolveReportsTx(tx, actor, t, resolutionDismiss); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := appendAuditLog(tx, actor, auditActionDismissReports, t.Type, t.ID, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// resolveReports は t への未処理の通報をすべて resolution で解決済みにする
+func resolveReports(actor auditActor, t reportTarget, resolution string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err := resolveReportsTx(tx, actor, t, resolution); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func resolveReportsTx(tx *sqlx.Tx, actor auditActor, t reportTarget, resolution string) error {
+	_, err := tx.Exec("UPDATE `reports` SET `resolved_at` = NOW(), `resolved_by` = ?, `resolution` = ? WHERE `target_type` = ? AND `target_id` = ? AND `resolved_at` IS NULL",
+		actor.UserID, resolution, t.Type, t.ID)
+	return err
+}
+
+// hideContent は t を非表示にして通報を解決済みにする。カウンタからも除く
+func hideContent(actor auditActor, t reportTarget) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	q := "UPDATE `posts` SET `hidden_at` = NOW() WHERE `id` = ? AND `hidden_at` IS NULL"
+	if t.Type == reportTargetComment {
+		// 投稿者が削除済みのコメントは削除したときに減らしているので、非表示にもしない
+		q = "UPDATE `comments` SET `hidden_at` = NOW() WHERE `id` = ? AND `hidden_at` IS NULL AND `deleted_at` IS NULL"
+	}
+	result, err := tx.Exec(q, t.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		if t.Type == reportTargetComment {
+			err = addCommentCounters(tx, t.AuthorID, t.PostID, -1)
+		} else {
+			// 投稿者が削除済みの投稿は削除したときに減らしている
+			_, err = tx.Exec("UPDATE `user_counters` SET `post_count` = `post_count` - 1 WHERE `user_id` = ? AND EXISTS (SELECT 1 FROM `posts` WHERE `id` = ? AND `deleted_at` IS NULL)", t.AuthorID, t.ID)
+		}
+		if err == nil {
+			err = appendAuditLog(tx, actor, auditActionHideContent, t.Type, t.ID, map[string]interface{}{"hidden": false}, map[string]interface{}{"hidden": true})
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := resolveReportsTx(tx, actor, t, resolutionHide); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if t.Type == reportTargetComment {
+		publishInvalidation(commentHidden{PostID: t.PostID, CommentID: t.ID})
+	} else {
+		publishInvalidation(postHidden{PostID: t.ID})
+	}
+	return nil
+}
+
+// banReportedAuthor は t の投稿者を BAN して通報を解決済みにする
+func banReportedAuthor(actor auditActor, t reportTarget) error {
+	g := reportGroup{}
+	err := db.Get(&g, "SELECT '' AS `target_type`, 0 AS `target_id`, COUNT(*) AS `cnt`, IFNULL(GROUP_CONCAT(DISTINCT `reason` ORDER BY `reason`), '') AS `reasons` FROM `reports` WHERE `target_type` = ? AND `target_id` = ? AND `resolved_at` IS NULL", t.Type, t.ID)
+	if err != nil {
+		return err
+	}
+	reason := fmt.Sprintf("通報 (%s %d: %s)", t.Type, t.ID, g.ReasonLabels())
+	ok, err := banUser(actor, t.AuthorID, reason, nil)
+	if err != nil {
+		return err
+	}
+	if ok {
+		publishInvalidation(userBanned{UserIDs: []int{t.AuthorID}})
+	}
+	return resolveReports(actor, t, resolutionBan)
+}
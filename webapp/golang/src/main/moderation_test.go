@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// 投稿者が削除済みのコメントを通報から非表示にしても、コメント数を二重に減らさない
+func TestHideDeletedComment(t *testing.T) {
+	setupIntegration(t)
+
+	u := createTestUser(t, "hider")
+	p := createTestPost(t, u.ID, "hide")
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tx.Exec("INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)", p.ID, u.ID, "deleted")
+	if err == nil {
+		err = addCommentCounters(tx, u.ID, p.ID, 1)
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cid, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleteComment と同じく削除したときにカウンタを減らす
+	tx, err = db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("UPDATE `comments` SET `deleted_at` = NOW() WHERE `id` = ?", cid)
+	if err == nil {
+		err = addCommentCounters(tx, u.ID, p.ID, -1)
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := getReportTarget(reportTargetComment, int(cid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !target.Deleted {
+		t.Error("Deleted = false for a deleted comment")
+	}
+	if err = hideContent(systemActor, target); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := getPostCommentCounts([]int{p.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[p.ID] != 0 {
+		t.Errorf("post comment_count = %d, want 0", counts[p.ID])
+	}
+	c, err := getUserCounter(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CommentCount != 0 || c.CommentedCount != 0 {
+		t.Errorf("user counters = %+v, want no comments", c)
+	}
+	var hiddenAt sql.NullString
+	if err = db.Get(&hiddenAt, "SELECT `hidden_at` FROM `comments` WHERE `id` = ?", cid); err != nil {
+		t.Fatal(err)
+	}
+	if hiddenAt.Valid {
+		t.Error("a deleted comment was hidden")
+	}
+}
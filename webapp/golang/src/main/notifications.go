@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// notification_preferences には既定 (有効) から変えた種類だけでなく、保存した設定をすべて持つ
+var notificationSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `notifications` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` int NOT NULL," +
+		"`type` varchar(16) NOT NULL," +
+		"`actor_id` int NOT NULL," +
+		"`post_id` int NOT NULL DEFAULT 0," +
+		"`comment_id` int NOT NULL DEFAULT 0," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`read_at` timestamp NULL DEFAULT NULL," +
+		"KEY `idx_user_id` (`user_id`, `id`)," +
+		"KEY `idx_actor_id` (`actor_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `notification_preferences` (" +
+		"`user_id` int NOT NULL," +
+		"`type` varchar(16) NOT NULL," +
+		"`enabled` tinyint NOT NULL," +
+		"PRIMARY KEY (`user_id`, `type`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	notificationComment = "comment"
+	notificationMention = "mention"
+	notificationFollow  = "follow"
+	notificationLike    = "like"
+
+	notificationQueueSize = 4096
+	notificationBatchSize = 100
+	notificationsPerPage  = 50
+
+	// キューが一杯のときに空くのを待つ時間
+	notificationEnqueueTimeout = 50 * time.Millisecond
+)
+
+type notificationType struct {
+	Name  string
+	Label string
+}
+
+var notificationTypes = []notificationType{
+	{notificationComment, "自分の投稿へのコメント"},
+	{notificationMention, "メンション"},
+	{notificationFollow, "フォロー"},
+	{notificationLike, "いいね"},
+}
+
+func ensureNotificationSchema() error {
+	for _, q := range notificationSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return addIndexIfNotExists("notifications", "idx_actor_id", "INDEX `idx_actor_id` (`actor_id`)")
+}
+
+// notification は UserID のユーザーへの通知。UserID を 0 にしておくと、書き込み時に PostID の投稿者を宛先にする
+type notification struct {
+	UserID    int
+	Type      string
+	ActorID   int
+	PostID    int
+	CommentID int
+}
+
+// 通知の書き込みはリクエストを待たせないよう writeNotifications がまとめて行う
+var notificationQueue = make(chan notification, notificationQueueSize)
+
+// enqueueNotifications はコミット後に呼ぶ。キューが一杯のときは notificationEnqueueTimeout だけ待ち、
+// それでも空かなければ残りの通知を捨てる。書き込みが追いつかないときに goroutine や DB への書き込みを増やさないため
+func enqueueNotifications(ns ...notification) {
+	var timeout *time.Timer
+	for i, n := range ns {
+		select {
+		case notificationQueue <- n:
+			continue
+		default:
+		}
+		if timeout == nil {
+			timeout = time.NewTimer(notificationEnqueueTimeout)
+			defer timeout.Stop()
+		}
+		select {
+		case notificationQueue <- n:
+		case <-timeout.C:
+			fmt.Printf("notification queue is full: dropped %d notifications\n", len(ns)-i)
+			return
+		}
+	}
+}
+
+func writeNotifications() {
+	for n := range notificationQueue {
+		batch := []notification{n}
+	drain:
+		for len(batch) < notificationBatchSize {
+			select {
+			case n := <-notificationQueue:
+				batch = append(batch, n)
+			default:
+				break drain
+			}
+		}
+		if err := insertNotifications(batch); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// insertNotifications は宛先を決め、自分自身への通知と受け取らない設定の種類を除いて書き込む
+func insertNotifications(ns []notification) error {
+	if err := resolvePostOwners(ns); err != nil {
+		return err
+	}
+
+	uids := []int{}
+	for _, n := range ns {
+		if n.UserID != 0 {
+			uids = append(uids, n.UserID)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	disabled, err := getDisabledNotificationTypes(uids)
+	if err != nil {
+		return err
+	}
+
+	values := []string{}
+	args := []interface{}{}
+	recipients := map[int]bool{}
+	for _, n := range ns {
+		if n.UserID == 0 || n.UserID == n.ActorID || disabled[n.UserID][n.Type] {
+			continue
+		}
+		// ブロック・ミュートしている相手からの通知は届けない
+		filter, err := getUserFilter(n.UserID)
+		if err != nil {
+			return err
+		}
+		if filter.hides(n.ActorID) {
+			continue
+		}
+		values = append(values, "(?,?,?,?,?)")
+		args = append(args, n.UserID, n.Type, n.ActorID, n.PostID, n.CommentID)
+		recipients[n.UserID] = true
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	query := "INSERT INTO `notifications` (`user_id`, `type`, `actor_id`, `post_id`, `comment_id`) VALUES " + strings.Join(values, ",")
+	if _, err := db.Exec(query, args...); err != nil {
+		return err
+	}
+	for uid := range recipients {
+		memcacheClient.Delete(getUnreadNotificationsCacheKey(uid))
+	}
+	return nil
+}
+
+func resolvePostOwners(ns []notification) error {
+	pids := []int{}
+	for _, n := range ns {
+		if n.UserID == 0 && n.PostID != 0 {
+			pids = append(pids, n.PostID)
+		}
+	}
+	if len(pids) == 0 {
+		return nil
+	}
+	q, args, err := sqlx.In("SELECT `id`, `user_id` FROM `posts` WHERE `id` IN (?)", pids)
+	if err != nil {
+		return err
+	}
+	posts := []Post{}
+	if err := db.Select(&posts, q, args...); err != nil {
+		return err
+	}
+	owners := map[int]int{}
+	for _, p := range posts {
+		owners[p.ID] = p.UserID
+	}
+	for i := range ns {
+		if ns[i].UserID == 0 {
+			ns[i].UserID = owners[ns[i].PostID]
+		}
+	}
+	return nil
+}
+
+func getDisabledNotificationTypes(uids []int) (map[int]map[string]bool, error) {
+	q, args, err := sqlx.In("SELECT `user_id`, `type` FROM `notification_preferences` WHERE `user_id` IN (?) AND `enabled` = 0", uids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		UserID int    `db:"user_id"`
+		Type   string `db:"type"`
+	}{}
+	if err := db.Select(&rows, q, args...); err != nil {
+		return nil, err
+	}
+	disabled := map[int]map[string]bool{}
+	for _, row := range rows {
+		if disabled[row.UserID] == nil {
+			disabled[row.UserID] = map[string]bool{}
+		}
+		disabled[row.UserID][row.Type] = true
+	}
+	return disabled, nil
+}
+
+func init() {
+	subscribeInvalidation(unreadNotificationsCacheHandler)
+}
+
+// unreadNotificationsCacheHandler は BAN や解除で数が変わる未読数のキャッシュを消す
+func unreadNotificationsCacheHandler(ev interface{}) {
+	var actorIDs []int
+	switch ev := ev.(type) {
+	case userBanned:
+		actorIDs = ev.UserIDs
+	case userUnbanned:
+		actorIDs = ev.UserIDs
+	default:
+		return
+	}
+	q, args, err := sqlx.In("SELECT DISTINCT `user_id` FROM `notifications` WHERE `actor_id` IN (?) AND `read_at` IS NULL", actorIDs)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	uids := []int{}
+	if err := db.Select(&uids, q, args...); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, uid := range uids {
+		memcacheClient.Delete(getUnreadNotificationsCacheKey(uid))
+	}
+}
+
+func getUnreadNotificationsCacheKey(uid int) string {
+	return "notifications_unread:" + strconv.Itoa(uid)
+}
+
+// UnreadNotifications はヘッダーのバッジに出す未読の通知の数。全ページで呼ばれるので memcache に置く
+func (u User) UnreadNotifications() int {
+	if u.ID == 0 {
+		return 0
+	}
+	key := getUnreadNotificationsCacheKey(u.ID)
+	if it, err := memcacheClient.Get(key); err == nil {
+		if n, err := strconv.Atoi(string(it.Value)); err == nil {
+			return n
+		}
+	}
+	n := 0
+	// getNotifications と同じく BAN されたユーザーからの通知は数えない
+	if err := db.Get(&n, "SELECT COUNT(*) FROM `notifications` n JOIN `users` u ON u.`id` = n.`actor_id` WHERE n.`user_id` = ? AND n.`read_at` IS NULL AND u.`del_flg` = 0", u.ID); err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	memcacheClient.Set(&memcache.Item{Key: key, Value: []byte(strconv.Itoa(n)), Expiration: 600})
+	return n
+}
+
+type notificationView struct {
+	ID        int        `db:"id"`
+	Type      string     `db:"type"`
+	ActorName string     `db:"actor_name"`
+	PostID    int        `db:"post_id"`
+	CommentID int        `db:"comment_id"`
+	CreatedAt time.Time  `db:"created_at"`
+	ReadAt    *time.Time `db:"read_at"`
+}
+
+func (n notificationView) Message() string {
+	switch n.Type {
+	case notificationComment:
+		return n.ActorName + "さんがあなたの投稿にコメントしました"
+	case notificationMention:
+		return n.ActorName + "さんがあなたをメンションしました"
+	case notificationFollow:
+		return n.ActorName + "さんにフォローされました"
+	case notificationLike:
+		return n.ActorName + "さんがあなたの投稿にいいねしました"
+	}
+	return ""
+}
+
+func (n notificationView) URL() string {
+	if n.PostID == 0 {
+		return "/@" + n.ActorName
+	}
+	return "/posts/" + strconv.Itoa(n.PostID)
+}
+
+// getNotifications は before より前 (0 なら最新) の通知を新しい順に返す。BAN されたユーザーからの通知は出さない
+func getNotifications(uid, before int) ([]notificationView, error) {
+	query := "SELECT n.`id`, n.`type`, u.`account_name` AS `actor_name`, n.`post_id`, n.`comment_id`, n.`created_at`, n.`read_at` " +
+		"FROM `notifications` n JOIN `users` u ON u.`id` = n.`actor_id` WHERE n.`user_id` = ? AND u.`del_flg` = 0"
+	args := []interface{}{uid}
+	if before > 0 {
+		query += " AND n.`id` < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY n.`id` DESC LIMIT ?"
+	args = append(args, notificationsPerPage)
+
+	ns := []notificationView{}
+	err := db.Select(&ns, query, args...)
+	return ns, err
+}
+
+func getNotificationPreferences(uid int) (map[string]bool, error) {
+	prefs := map[string]bool{}
+	for _, t := range notificationTypes {
+		prefs[t.Name] = true
+	}
+	rows := []struct {
+		Type    string `db:"type"`
+		Enabled bool   `db:"enabled"`
+	}{}
+	if err := db.Select(&rows, "SELECT `type`, `enabled` FROM `notification_preferences` WHERE `user_id` = ?", uid); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		prefs[row.Type] = row.Enabled
+	}
+	return prefs, nil
+}
+
+func getNotificationsPage(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	ns, err := getNotifications(me.ID, before)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	prefs, err := getNotificationPreferences(me.ID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	nextBefore := 0
+	if len(ns) == notificationsPerPage {
+		nextBefore = ns[len(ns)-1].ID
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("notifications.html")),
+	).Execute(w, struct {
+		Notifications []notificationView
+		NextBefore    int
+		Types         []notificationType
+		Preferences   map[string]bool
+		Me            User
+		CSRFToken     string
+		Flash         string
+	}{ns, nextBefore, notificationTypes, prefs, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postNotificationsRead は id の通知を、id が無ければすべての通知を既読にする
+func postNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	var err error
+	if s := r.FormValue("id"); s != "" {
+		id, aerr := strconv.Atoi(s)
+		if aerr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, err = db.Exec("UPDATE `notifications` SET `read_at` = NOW() WHERE `id` = ? AND `user_id` = ? AND `read_at` IS NULL", id, me.ID)
+	} else {
+		_, err = db.Exec("UPDATE `notifications` SET `read_at` = NOW() WHERE `user_id` = ? AND `read_at` IS NULL", me.ID)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	memcacheClient.Delete(getUnreadNotificationsCacheKey(me.ID))
+
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+func postNotificationsPreferences(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	for _, t := range notificationTypes {
+		enabled := r.FormValue(t.Name) == "1"
+		_, err := db.Exec("INSERT INTO `notification_preferences` (`user_id`, `type`, `enabled`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `enabled` = VALUES(`enabled`)",
+			me.ID, t.Name, enabled)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	redirectWithNotice(w, r, "/notifications", "通知の設定を保存しました")
+}
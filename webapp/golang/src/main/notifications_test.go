@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// キューが一杯のときは待ってから捨て、呼び出し元を止め続けない
+func TestEnqueueNotificationsFullQueue(t *testing.T) {
+	orig := notificationQueue
+	defer func() { notificationQueue = orig }()
+	notificationQueue = make(chan notification, 1)
+
+	start := time.Now()
+	enqueueNotifications(notification{UserID: 1}, notification{UserID: 2}, notification{UserID: 3})
+	if elapsed := time.Since(start); elapsed < notificationEnqueueTimeout || elapsed > 10*notificationEnqueueTimeout {
+		t.Errorf("enqueueNotifications took %s, want about %s", elapsed, notificationEnqueueTimeout)
+	}
+	if len(notificationQueue) != 1 || (<-notificationQueue).UserID != 1 {
+		t.Error("the queued notification was replaced")
+	}
+
+	// 待っている間に空けば入る
+	notificationQueue <- notification{UserID: 1}
+	go func() {
+		time.Sleep(notificationEnqueueTimeout / 5)
+		<-notificationQueue
+	}()
+	enqueueNotifications(notification{UserID: 2})
+	if n := <-notificationQueue; n.UserID != 2 {
+		t.Errorf("queued notification for user %d, want 2", n.UserID)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// 投稿者による投稿の編集と削除。削除は deleted_at を入れるだけで行は残し、
+// 画像は取り消しや調査に備えて postImageGracePeriod の間だけ残してから消す
+const postImageGracePeriod = 24 * time.Hour
+
+func ensurePostEditSchema() error {
+	if err := addColumnIfNotExists("posts", "deleted_at", "timestamp NULL DEFAULT NULL"); err != nil {
+		return err
+	}
+	return addColumnIfNotExists("posts", "image_removed_at", "timestamp NULL DEFAULT NULL")
+}
+
+// getOwnPost は me の投稿で削除されていないものを返す。他人の投稿の場合は sql.ErrNoRows
+func getOwnPost(me User, pid int) (Post, error) {
+	p := Post{}
+	err := db.Get(&p, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `id` = ? AND `user_id` = ? AND `deleted_at` IS NULL", pid, me.ID)
+	return p, err
+}
+
+func isDeletedPost(pid int) (bool, error) {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM `posts` WHERE `id` = ? AND `deleted_at` IS NOT NULL", pid)
+	return n > 0, err
+}
+
+func getPostsIDEdit(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	pid, err := strconv.Atoi(c.URLParams["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, err := getOwnPost(me, pid)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("post_edit.html"),
+	)).Execute(w, struct {
+		Post      Post
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{p, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postPostsIDEdit(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(c.URLParams["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p, err := getOwnPost(me, pid)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	body, verr := validatePostBody(r.FormValue("body"))
+	if verr != nil {
+		redirectWithNotice(w, r, "/posts/"+strconv.Itoa(p.ID)+"/edit", verr.Error())
+		return
+	}
+	p.Body = body
+	tx, err := db.Beginx()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if _, err := tx.Exec("UPDATE `posts` SET `body` = ? WHERE `id` = ? AND `user_id` = ? AND `deleted_at` IS NULL", p.Body, p.ID, me.ID); err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	if err := setPostTags(tx, p.ID, p.Body, p.CreatedAt); err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	mentions, err := setMentions(tx, mentionSource{mentionSourcePost, p.ID, p.ID, me.ID}, p.Body)
+	if err != nil {
+		tx.Rollback()
+		fmt.Println(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	publishInvalidation(postUpdated{Post: p})
+	enqueueNotifications(mentions...)
+
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(p.ID), http.StatusFound)
+}
+
+func postPostsIDDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(c.URLParams["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	deleted, err := deletePost(me, pid)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	publishInvalidation(postDeleted{PostID: pid})
+
+	http.Redirect(w, r, "/@"+me.AccountName, http.StatusFound)
+}
+
+// deletePost は me の投稿 pid を削除済みにする。me の投稿でないか削除済みの場合は false を返す
+func deletePost(me User, pid int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	hidden := false
+	err = tx.Get(&hidden, "SELECT `hidden_at` IS NOT NULL FROM `posts` WHERE `id` = ? AND `user_id` = ? AND `deleted_at` IS NULL FOR UPDATE", pid, me.ID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return false, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE `posts` SET `deleted_at` = NOW() WHERE `id` = ?", pid); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	// 非表示にしたときに既に減らしている
+	if !hidden {
+		if _, err := tx.Exec("UPDATE `user_counters` SET `post_count` = `post_count` - 1 WHERE `user_id` = ?", me.ID); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// removeDeletedPostImages は削除から postImageGracePeriod 以上経った投稿の画像を消す
+func removeDeletedPostImages() error {
+	posts := []Post{}
+	err := db.Select(&posts, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `deleted_at` <= ? AND `image_removed_at` IS NULL LIMIT 1000", time.Now().Add(-postImageGracePeriod))
+	if err != nil {
+		return err
+	}
+	for _, p := range posts {
+		if err := os.Remove(PostsImageDir + path.Base(imageURL(p))); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE `posts` SET `image_removed_at` = NOW() WHERE `id` = ?", p.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func watchDeletedPostImages(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := removeDeletedPostImages(); err != nil {
+			fmt.Printf("error removing deleted post images: %s\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// 権限はロールにまとめて付与する。ロールと権限の対応はコードで持ち、
+// 誰にどのロールを付与したかだけを user_roles に保存する。
+// users.authority はロールを1つでも持っているかどうかで、ヘッダーに管理者用ページへのリンクを出すのに使う
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+)
+
+const (
+	permBanUsers      = "ban_users"
+	permDeleteContent = "delete_content"
+	permViewAudit     = "view_audit"
+	permManageRoles   = "manage_roles"
+	permViewMetrics   = "view_metrics" // キャッシュの状態など運用向けの内部情報。監査ログとは分ける
+)
+
+var (
+	errLastAdmin = errors.New("rbac: cannot revoke the last admin")
+	errOutranked = errors.New("rbac: target has permissions the actor lacks")
+)
+
+var roles = []string{roleAdmin, roleModerator}
+
+var rolePermissions = map[string][]string{
+	roleAdmin:     {permBanUsers, permDeleteContent, permViewAudit, permManageRoles, permViewMetrics},
+	roleModerator: {permBanUsers, permDeleteContent},
+}
+
+var roleSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `user_roles` (" +
+		"`user_id` int NOT NULL," +
+		"`role` varchar(32) NOT NULL," +
+		"`granted_by` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `role`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// authority = 1 でロールを1つも持っていないユーザーは、ロール導入前の管理者なので admin にする。
+	// ロールをすべて外したユーザーは authority = 0 になるので、起動し直しても admin には戻らない
+	"INSERT IGNORE INTO `user_roles` (`user_id`, `role`, `granted_by`) " +
+		"SELECT u.`id`, '" + roleAdmin + "', 0 FROM `users` u WHERE u.`authority` = 1 " +
+		"AND NOT EXISTS (SELECT 1 FROM `user_roles` r WHERE r.`user_id` = u.`id`)",
+}
+
+func ensureRoleSchema() error {
+	for _, q := range roleSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func getUserRoles(uid int) ([]string, error) {
+	rs := []string{}
+	err := db.Select(&rs, "SELECT `role` FROM `user_roles` WHERE `user_id` = ? ORDER BY `role`", uid)
+	return rs, err
+}
+
+func rolesPermissions(rs []string) map[string]bool {
+	perms := make(map[string]bool)
+	for _, role := range rs {
+		for _, p := range rolePermissions[role] {
+			perms[p] = true
+		}
+	}
+	return perms
+}
+
+func hasPermission(u User, perm string) (bool, error) {
+	// ロールを持っていないユーザーは DB を見るまでもない
+	if u.Authority == 0 {
+		return false, nil
+	}
+	rs, err := getUserRoles(u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range rs {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// requirePermission は perm を持っているユーザーだけが h を呼べるようにする。
+// ルーティング表で h を包んで、ルートごとに必要な権限を宣言する
+func requirePermission(perm string, h interface{}) web.HandlerFunc {
+	var handler web.HandlerFunc
+	switch h := h.(type) {
+	case func(web.C, http.ResponseWriter, *http.Request):
+		handler = h
+	case func(http.ResponseWriter, *http.Request):
+		handler = func(c web.C, w http.ResponseWriter, r *http.Request) { h(w, r) }
+	default:
+		panic(fmt.Sprintf("requirePermission: unsupported handler type %T", h))
+	}
+
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		me := getSessionUser(r)
+		if !isLogin(me) {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		ok, err := hasPermission(me, perm)
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(c, w, r)
+	}
+}
+
+type staffUser struct {
+	User
+	Roles []string
+}
+
+func getStaffUsers() ([]staffUser, error) {
+	rows := []struct {
+		UserID      int    `db:"user_id"`
+		AccountName string `db:"account_name"`
+		Role        string `db:"role"`
+	}{}
+	err := db.Select(&rows, "SELECT r.`user_id`, u.`account_name`, r.`role` FROM `user_roles` r JOIN `users` u ON u.`id` = r.`user_id` ORDER BY u.`account_name`, r.`role`")
+	if err != nil {
+		return nil, err
+	}
+	staff := []staffUser{}
+	for _, row := range rows {
+		if len(staff) == 0 || staff[len(staff)-1].ID != row.UserID {
+			staff = append(staff, staffUser{User: User{ID: row.UserID, AccountName: row.AccountName}})
+		}
+		s := &staff[len(staff)-1]
+		s.Roles = append(s.Roles, row.Role)
+	}
+	return staff, nil
+}
+
+// setUserRole は uid のユーザーに role を付与 (grant = true) または剥奪する。変化が無かった場合は false を返す
+func setUserRole(actor auditActor, uid int, role string, grant bool) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	before := []string{}
+	if err := tx.Select(&before, "SELECT `role` FROM `user_roles` WHERE `user_id` = ? ORDER BY `role` FOR UPDATE", uid); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	action := auditActionGrantRole
+	if grant {
+		_, err = tx.Exec("INSERT IGNORE INTO `user_roles` (`user_id`, `role`, `granted_by`) VALUES (?,?,?)", uid, role, actor.UserID)
+	} else {
+		action = auditActionRevokeRole
+		if role == roleAdmin {
+			// 管理者がいなくなるとロールを付与し直せなくなる
+			admins := 0
+			if err := tx.Get(&admins, "SELECT COUNT(*) FROM `user_roles` WHERE `role` = ? FOR UPDATE", roleAdmin); err != nil {
+				tx.Rollback()
+				return false, err
+			}
+			if admins <= 1 {
+				tx.Rollback()
+				return false, errLastAdmin
+			}
+		}
+		_, err = tx.Exec("DELETE FROM `user_roles` WHERE `user_id` = ? AND `role` = ?", uid, role)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	after := []string{}
+	if err := tx.Select(&after, "SELECT `role` FROM `user_roles` WHERE `user_id` = ? ORDER BY `role`", uid); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if strings.Join(before, ",") == strings.Join(after, ",") {
+		tx.Rollback()
+		return false, nil
+	}
+
+	authority := 0
+	if len(after) > 0 {
+		authority = 1
+	}
+	if _, err := tx.Exec("UPDATE `users` SET `authority` = ? WHERE `id` = ?", authority, uid); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := appendAuditLog(tx, actor, action, "user", uid, map[string]interface{}{"roles": before}, map[string]interface{}{"roles": after}); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	staff, err := getStaffUsers()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("roles.html")),
+	).Execute(w, struct {
+		Staff     []staffUser
+		Roles     []string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{staff, roles, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminRoles(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	notice := ""
+	role := r.FormValue("role")
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ?", r.FormValue("account_name"))
+	switch {
+	case err != nil:
+		notice = "ユーザーが見つかりません"
+	case !isRole(role):
+		notice = "ロールが正しくありません"
+	default:
+		changed, err := setUserRole(newAuditActor(c, r, me), u.ID, role, r.FormValue("action") == "grant")
+		if err == errLastAdmin {
+			notice = "最後の admin のロールは外せません"
+		} else if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if changed {
+			publishInvalidation(userRolesChanged{UserID: u.ID})
+		}
+	}
+
+	if notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+	}
+	http.Redirect(w, r, "/admin/roles", http.StatusFound)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/zenazn/goji"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+type route struct {
+	Method string
+	// Name はログ解析などで URI を集約するときの表記 (例: "/posts/:id")
+	Name    string
+	Pattern web.PatternType
+	Handler web.HandlerType
+}
+
+var publicFileServer = http.FileServer(http.Dir("../../../public"))
+
+var routes = []route{
+	{"GET", "/initialize", "/initialize", getInitialize},
+	{"GET", "/login", "/login", getLogin},
+	{"POST", "/login", "/login", postLogin},
+	{"GET", "/register", "/register", getRegister},
+	{"POST", "/register", "/register", postRegister},
+	{"GET", "/logout", "/logout", getLogout},
+	{"GET", "/", "/", getIndex},
+	{"GET", "/@:accountName", regexp.MustCompile(`^/@(?P<accountName>[0-9a-zA-Z_]+)$`), getAccountName},
+	{"GET", "/@:accountName/posts", regexp.MustCompile(`^/@(?P<accountName>[0-9a-zA-Z_]+)/posts$`), getAccountNamePosts},
+	{"POST", "/@:accountName/follow", regexp.MustCompile(`^/@(?P<accountName>[0-9a-zA-Z_]+)/follow$`), postAccountNameFollow},
+	{"POST", "/@:accountName/unfollow", regexp.MustCompile(`^/@(?P<accountName>[0-9a-zA-Z_]+)/unfollow$`), postAccountNameUnfollow},
+	{"POST", "/@:accountName/:action", regexp.MustCompile(`^/@(?P<accountName>[0-9a-zA-Z_]+)/(?P<action>block|unblock|mute|unmute)$`), postAccountNameRelation},
+	{"GET", "/blocks", "/blocks", getBlocks},
+	{"GET", "/posts", "/posts", getPosts},
+	{"GET", "/posts/:id", "/posts/:id", getPostsID},
+	{"GET", "/posts/:id/edit", "/posts/:id/edit", getPostsIDEdit},
+	{"POST", "/posts/:id/edit", "/posts/:id/edit", postPostsIDEdit},
+	{"POST", "/posts/:id/delete", "/posts/:id/delete", postPostsIDDelete},
+	{"POST", "/posts/:id/like", "/posts/:id/like", postPostsIDLike},
+	{"POST", "/", "/", postIndex},
+	{"POST", "/comment", "/comment", postComment},
+	{"GET", "/tags/:tag", "/tags/:tag", getTag},
+	{"GET", "/search", "/search", getSearch},
+	{"GET", "/notifications", "/notifications", getNotificationsPage},
+	{"POST", "/notifications/read", "/notifications/read", postNotificationsRead},
+	{"POST", "/notifications/preferences", "/notifications/preferences", postNotificationsPreferences},
+	{"GET", "/comments/:id/edit", "/comments/:id/edit", getCommentsIDEdit},
+	{"POST", "/comments/:id/edit", "/comments/:id/edit", postCommentsIDEdit},
+	{"POST", "/comments/:id/delete", "/comments/:id/delete", postCommentsIDDelete},
+	{"POST", "/report", "/report", postReport},
+	{"GET", "/admin/banned", "/admin/banned", requirePermission(permBanUsers, getAdminBanned)},
+	{"POST", "/admin/banned", "/admin/banned", requirePermission(permBanUsers, postAdminBanned)},
+	{"POST", "/admin/unban", "/admin/unban", requirePermission(permBanUsers, postAdminUnban)},
+	{"GET", "/admin/audit", "/admin/audit", requirePermission(permViewAudit, getAdminAudit)},
+	{"GET", "/admin/reports", "/admin/reports", requirePermission(permDeleteContent, getAdminReports)},
+	{"POST", "/admin/reports", "/admin/reports", requirePermission(permDeleteContent, postAdminReports)},
+	{"GET", "/admin/roles", "/admin/roles", requirePermission(permManageRoles, getAdminRoles)},
+	{"POST", "/admin/roles", "/admin/roles", requirePermission(permManageRoles, postAdminRoles)},
+	{"GET", "/admin/debug/vars", "/admin/debug/vars", requirePermission(permViewMetrics, getAdminDebugVars)},
+	{"GET", "/api/posts", "/api/posts", getAPIPosts},
+	{"GET", "/image/:id", "/image/*", publicFileServer},
+	{"GET", "/*", "/*", publicFileServer},
+}
+
+func registerRoutes() {
+	// 監査ログに nginx ではなくクライアントの IP を残すため
+	goji.Insert(realIP, middleware.RequestID)
+	for _, rt := range routes {
+		switch rt.Method {
+		case "GET":
+			goji.Get(rt.Pattern, rt.Handler)
+		case "POST":
+			goji.Post(rt.Pattern, rt.Handler)
+		}
+	}
+}
+
+// realIP は nginx が $remote_addr を入れる X-Real-IP を RemoteAddr にする。
+// middleware.RealIP が見る X-Forwarded-For の先頭はクライアントが送った値のまま残るので使わない
+func realIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			r.RemoteAddr = ip.String()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type routeMatcher struct {
+	method string
+	name   string
+	re     *regexp.Regexp
+}
+
+var routeMatchers []routeMatcher
+
+func init() {
+	for _, rt := range routes {
+		routeMatchers = append(routeMatchers, routeMatcher{rt.Method, rt.Name, routeNameRegexp(rt.Name)})
+	}
+}
+
+// routeNameRegexp は "/posts/:id" や "/@:accountName" の表記から URI にマッチする正規表現を作る
+func routeNameRegexp(name string) *regexp.Regexp {
+	segs := strings.Split(name, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "*":
+			segs[i] = ".*"
+		case strings.HasPrefix(seg, ":"):
+			segs[i] = "[^/]+"
+		case strings.Contains(seg, ":"):
+			j := strings.Index(seg, ":")
+			segs[i] = regexp.QuoteMeta(seg[:j]) + "[^/]+"
+		default:
+			segs[i] = regexp.QuoteMeta(seg)
+		}
+	}
+	return regexp.MustCompile("^" + strings.Join(segs, "/") + "$")
+}
+
+// normalizeRoute はリクエストのメソッドと URI をルーティング表の表記に変換する。
+// どのルートにもマッチしない場合はクエリを除いたパスをそのまま返す
+func normalizeRoute(method, uri string) string {
+	p := uri
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, m := range routeMatchers {
+		if m.method == method && m.re.MatchString(p) {
+			return m.name
+		}
+	}
+	return p
+}
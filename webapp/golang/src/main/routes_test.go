@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"no header", nil, "192.0.2.1:1234"},
+		{"x-real-ip", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"spoofed x-forwarded-for", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7", "X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"x-forwarded-for only", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "192.0.2.1:1234"},
+		{"invalid x-real-ip", map[string]string{"X-Real-IP": "not an ip"}, "192.0.2.1:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			var got string
+			realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
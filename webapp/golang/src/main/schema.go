@@ -0,0 +1,40 @@
+package main
+
+// addColumnIfNotExists は既存のテーブルにカラムを追加する。
+// MySQL 5.7 には ADD COLUMN IF NOT EXISTS が無いので information_schema を見てから ALTER する
+func addColumnIfNotExists(table, column, definition string) error {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + definition)
+	return err
+}
+
+func indexExists(table, index string) (bool, error) {
+	n := 0
+	err := db.Get(&n, "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?", table, index)
+	return n > 0, err
+}
+
+// addIndexIfNotExists は既存のテーブルにインデックスを追加する。definition は ADD に続く部分 (FULLTEXT INDEX ... など)
+func addIndexIfNotExists(table, index, definition string) error {
+	ok, err := indexExists(table, index)
+	if err != nil || ok {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE `" + table + "` ADD " + definition)
+	return err
+}
+
+// modifyColumnCollation は既存のカラムの照合順序が collation でなければ definition で作り直す
+func modifyColumnCollation(table, column, collation, definition string) error {
+	current := ""
+	err := db.Get(&current, "SELECT IFNULL(COLLATION_NAME, '') FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column)
+	if err != nil || current == collation {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE `" + table + "` MODIFY COLUMN `" + column + "` " + definition)
+	return err
+}
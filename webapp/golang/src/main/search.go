@@ -0,0 +1,485 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxSearchTerms   = 5
+	searchUsersLimit = 20
+)
+
+// Searcher は投稿本文・コメントとアカウント名の検索。
+// SearchPosts は selectPostsPage と同じ列・並び順・ページングで投稿を返し、BAN 済みユーザーの除外は makePosts に任せる
+type Searcher interface {
+	SearchPosts(terms []string, pg postsPage) ([]Post, error)
+	SearchUsers(terms []string, limit int) ([]User, error)
+}
+
+var searcher Searcher = mysqlSearcher{ngramTokenSize: 2}
+
+// setupSearcher は ISUCONP_SEARCH=memory ならプロセス内の転置インデックスを、それ以外は MySQL の全文検索を使う
+func setupSearcher() error {
+	if os.Getenv("ISUCONP_SEARCH") != "memory" {
+		if err := checkSearchSchema(); err != nil {
+			return err
+		}
+		s := mysqlSearcher{}
+		if err := db.Get(&s.ngramTokenSize, "SELECT @@ngram_token_size"); err != nil {
+			return err
+		}
+		searcher = s
+		return nil
+	}
+	s := newMemorySearcher()
+	if err := s.load(); err != nil {
+		return err
+	}
+	subscribeInvalidation(s.handle)
+	searcher = s
+	return nil
+}
+
+// 日本語は単語に分かち書きされないので ngram パーサーで索引を作る。
+// 行の多いテーブルへの ALTER は時間がかかり書き込みも止まるので、起動時には作らず
+// デプロイ前に create-search-index サブコマンドで作っておく
+var searchIndexes = []struct {
+	table, index, definition string
+}{
+	{"posts", "ft_body", "FULLTEXT INDEX `ft_body` (`body`) WITH PARSER ngram"},
+	{"comments", "ft_comment", "FULLTEXT INDEX `ft_comment` (`comment`) WITH PARSER ngram"},
+}
+
+// checkSearchSchema は全文検索の索引があるかだけを確かめる
+func checkSearchSchema() error {
+	for _, idx := range searchIndexes {
+		ok, err := indexExists(idx.table, idx.index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("fulltext index %s.%s is missing; run `app create-search-index` before starting the server", idx.table, idx.index)
+		}
+	}
+	return nil
+}
+
+func createSearchIndexes() error {
+	for _, idx := range searchIndexes {
+		if err := addIndexIfNotExists(idx.table, idx.index, idx.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCreateSearchIndex は全文検索の索引を作る。既にあれば何もしない
+func runCreateSearchIndex(args []string) {
+	fs := flag.NewFlagSet("create-search-index", flag.ExitOnError)
+	fs.Parse(args)
+
+	db = openDB()
+	defer db.Close()
+
+	if err := createSearchIndexes(); err != nil {
+		log.Fatalf("Failed to create search indexes: %s", err.Error())
+	}
+	fmt.Println("created search indexes")
+}
+
+// parseSearchQuery はクエリを空白で区切った語にする。すべての語を含むものを探す
+func parseSearchQuery(q string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, t := range strings.Fields(normalizeText(q, false)) {
+		t = strings.ToLower(t)
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		terms = append(terms, t)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// highlightRegexp は検索語のいずれかに大文字小文字を区別せずマッチする
+func highlightRegexp(terms []string) *regexp.Regexp {
+	if len(terms) == 0 {
+		return nil
+	}
+	quoted := make([]string, 0, len(terms))
+	for _, t := range terms {
+		quoted = append(quoted, regexp.QuoteMeta(t))
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// mysqlSearcher は ngram の全文索引で検索する。ngramTokenSize は MySQL の ngram_token_size
+type mysqlSearcher struct {
+	ngramTokenSize int
+}
+
+// termCond は column に term が含まれる条件を返す。
+// ngram_token_size より短い語は索引に無いので LIKE で探す
+func (s mysqlSearcher) termCond(column, term string) (string, interface{}) {
+	if utf8.RuneCountInString(term) < s.ngramTokenSize {
+		return column + " LIKE CONCAT('%', ?, '%')", escapeLike(term)
+	}
+	return "MATCH (" + column + ") AGAINST (? IN BOOLEAN MODE)", `"` + strings.Replace(term, `"`, "", -1) + `"`
+}
+
+// SearchPosts はすべての語がそれぞれ本文か表示中のコメントのどれかに含まれる投稿を返す。memorySearcher と同じ条件
+func (s mysqlSearcher) SearchPosts(terms []string, pg postsPage) ([]Post, error) {
+	conds := make([]string, 0, len(terms))
+	args := make([]interface{}, 0, len(terms)*2)
+	for _, t := range terms {
+		bodyCond, bodyArg := s.termCond("`body`", t)
+		commentCond, commentArg := s.termCond("`comment`", t)
+		conds = append(conds, "("+bodyCond+" OR `id` IN ("+
+			"SELECT `post_id` FROM `comments` WHERE "+commentCond+" AND `hidden_at` IS NULL AND `deleted_at` IS NULL))")
+		args = append(args, bodyArg, commentArg)
+	}
+	return selectPostsPage(strings.Join(conds, " AND "), args, pg)
+}
+
+func (mysqlSearcher) SearchUsers(terms []string, limit int) ([]User, error) {
+	conds := []string{"`del_flg` = 0"}
+	args := []interface{}{}
+	for _, t := range terms {
+		conds = append(conds, "`account_name` LIKE CONCAT('%', ?, '%')")
+		args = append(args, escapeLike(t))
+	}
+	args = append(args, limit)
+	users := []User{}
+	err := db.Select(&users, "SELECT `id`, `account_name`, `authority`, `del_flg`, `created_at` FROM `users` WHERE "+
+		strings.Join(conds, " AND ")+" ORDER BY `account_name` LIMIT ?", args...)
+	return users, err
+}
+
+// memorySearcher はプロセス内の bigram の転置インデックスで検索する。
+// 起動時に DB から読み込み、以降はキャッシュと同じイベントで追従する。テストや開発用で、複数台構成では使えない
+type memorySearcher struct {
+	mu       sync.RWMutex
+	docs     map[int]*searchDoc
+	postings map[string]map[int]bool
+	users    map[int]User
+}
+
+// searchDoc は投稿1件分の本文と表示中のコメント
+type searchDoc struct {
+	post     Post
+	comments map[int]string
+}
+
+func newMemorySearcher() *memorySearcher {
+	return &memorySearcher{
+		docs:     map[int]*searchDoc{},
+		postings: map[string]map[int]bool{},
+		users:    map[int]User{},
+	}
+}
+
+// searchTokens は文字と数字の並びを bigram に分ける。1文字だけの並びは bigram にならないので索引に入らない
+func searchTokens(s string) []string {
+	tokens := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		rs := []rune(word)
+		for i := 0; i+1 < len(rs); i++ {
+			tokens = append(tokens, string(rs[i:i+2]))
+		}
+	}
+	return tokens
+}
+
+func (d *searchDoc) text() string {
+	parts := []string{d.post.Body}
+	for _, c := range d.comments {
+		parts = append(parts, c)
+	}
+	return strings.ToLower(strings.Join(parts, "\n"))
+}
+
+func (s *memorySearcher) load() error {
+	posts := []Post{}
+	if err := db.Select(&posts, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `hidden_at` IS NULL AND `deleted_at` IS NULL"); err != nil {
+		return err
+	}
+	comments := []Comment{}
+	if err := db.Select(&comments, "SELECT `id`, `post_id`, `comment` FROM `comments` WHERE `hidden_at` IS NULL AND `deleted_at` IS NULL"); err != nil {
+		return err
+	}
+	users := []User{}
+	if err := db.Select(&users, "SELECT `id`, `account_name`, `authority`, `del_flg`, `created_at` FROM `users`"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range posts {
+		s.docs[p.ID] = &searchDoc{post: p, comments: map[int]string{}}
+	}
+	for _, c := range comments {
+		if d, ok := s.docs[c.PostID]; ok {
+			d.comments[c.ID] = c.Comment
+		}
+	}
+	for id := range s.docs {
+		s.index(id)
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return nil
+}
+
+// index と unindex は mu を持った状態で呼ぶ
+func (s *memorySearcher) index(id int) {
+	for _, t := range searchTokens(s.docs[id].text()) {
+		if s.postings[t] == nil {
+			s.postings[t] = map[int]bool{}
+		}
+		s.postings[t][id] = true
+	}
+}
+
+func (s *memorySearcher) unindex(id int) {
+	for _, t := range searchTokens(s.docs[id].text()) {
+		delete(s.postings[t], id)
+		if len(s.postings[t]) == 0 {
+			delete(s.postings, t)
+		}
+	}
+}
+
+// update は投稿 id を fn で書き換えて索引を作り直す。fn が false を返したら投稿を索引から除く
+func (s *memorySearcher) update(id int, fn func(d *searchDoc) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	s.unindex(id)
+	if !fn(d) {
+		delete(s.docs, id)
+		return
+	}
+	s.index(id)
+}
+
+func (s *memorySearcher) handle(ev interface{}) {
+	switch ev := ev.(type) {
+	case postCreated:
+		s.mu.Lock()
+		s.docs[ev.Post.ID] = &searchDoc{post: ev.Post, comments: map[int]string{}}
+		s.index(ev.Post.ID)
+		s.mu.Unlock()
+	case postUpdated:
+		s.update(ev.Post.ID, func(d *searchDoc) bool { d.post.Body = ev.Post.Body; return true })
+	case postDeleted:
+		s.update(ev.PostID, func(d *searchDoc) bool { return false })
+	case postHidden:
+		s.update(ev.PostID, func(d *searchDoc) bool { return false })
+	case commentCreated:
+		s.update(ev.Comment.PostID, func(d *searchDoc) bool { d.comments[ev.Comment.ID] = ev.Comment.Comment; return true })
+	case commentUpdated:
+		s.update(ev.Comment.PostID, func(d *searchDoc) bool { d.comments[ev.Comment.ID] = ev.Comment.Comment; return true })
+	case commentDeleted:
+		s.update(ev.PostID, func(d *searchDoc) bool { delete(d.comments, ev.CommentID); return true })
+	case commentHidden:
+		s.update(ev.PostID, func(d *searchDoc) bool { delete(d.comments, ev.CommentID); return true })
+	case userRegistered:
+		s.mu.Lock()
+		s.users[ev.User.ID] = ev.User
+		s.mu.Unlock()
+	case userBanned:
+		s.setUsersDelFlg(ev.UserIDs, 1)
+	case userUnbanned:
+		s.setUsersDelFlg(ev.UserIDs, 0)
+	}
+}
+
+func (s *memorySearcher) setUsersDelFlg(uids []int, delFlg int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, uid := range uids {
+		if u, ok := s.users[uid]; ok {
+			u.DelFlg = delFlg
+			s.users[uid] = u
+		}
+	}
+}
+
+func (s *memorySearcher) SearchPosts(terms []string, pg postsPage) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// bigram の積で候補を絞り、本文に語がそのまま含まれるかで確かめる。
+	// 1文字の語 (「猫」など) のように bigram が無い語しかない場合は全件を確かめる
+	var candidates map[int]bool
+	for _, term := range terms {
+		for _, t := range searchTokens(term) {
+			ids := s.postings[t]
+			next := map[int]bool{}
+			for id := range ids {
+				if candidates == nil || candidates[id] {
+					next[id] = true
+				}
+			}
+			candidates = next
+		}
+	}
+	if candidates == nil {
+		candidates = make(map[int]bool, len(s.docs))
+		for id := range s.docs {
+			candidates[id] = true
+		}
+	}
+
+	results := []Post{}
+	for id := range candidates {
+		d := s.docs[id]
+		text := d.text()
+		matched := true
+		for _, term := range terms {
+			if !strings.Contains(text, term) {
+				matched = false
+				break
+			}
+		}
+		if matched && pg.includes(d.post) {
+			results = append(results, d.post)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].CreatedAt.Equal(results[j].CreatedAt) {
+			return results[i].CreatedAt.After(results[j].CreatedAt)
+		}
+		return results[i].ID > results[j].ID
+	})
+	if len(results) > pg.Limit {
+		results = results[:pg.Limit]
+	}
+	return results, nil
+}
+
+func (s *memorySearcher) SearchUsers(terms []string, limit int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for _, u := range s.users {
+		if u.DelFlg != 0 {
+			continue
+		}
+		name := strings.ToLower(u.AccountName)
+		matched := true
+		for _, t := range terms {
+			if !strings.Contains(name, t) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].AccountName < users[j].AccountName })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// includes は投稿 p がこのページの範囲 (カーソルより古い) にあるか
+func (pg postsPage) includes(p Post) bool {
+	if pg.Cursor != nil {
+		c := pg.Cursor
+		return p.CreatedAt.Before(c.CreatedAt) || (p.CreatedAt.Equal(c.CreatedAt) && p.ID < c.ID)
+	}
+	if pg.MaxCreatedAt != nil {
+		return !p.CreatedAt.After(*pg.MaxCreatedAt)
+	}
+	return true
+}
+
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	terms := parseSearchQuery(q)
+
+	pg, pgerr := parsePostsPage(r)
+	if pgerr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results := []Post{}
+	users := []User{}
+	if len(terms) > 0 {
+		var err error
+		results, err = searcher.SearchPosts(terms, pg)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if pg.Cursor == nil && pg.MaxCreatedAt == nil {
+			users, err = searcher.SearchUsers(terms, searchUsersLimit)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+
+	me := getSessionUser(r)
+	posts, merr := makePosts(results, me, getCSRFToken(r), false)
+	if merr != nil {
+		fmt.Println(merr)
+		return
+	}
+	hl := highlightRegexp(terms)
+	for i := range posts {
+		posts[i].Highlight = hl
+	}
+
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		if len(posts) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		postsTemplate.Execute(w, posts)
+		return
+	}
+
+	searchURL := "/search?" + url.Values{"q": {q}}.Encode()
+	nextURL := ""
+	if next := nextCursor(results, pg); next != "" {
+		nextURL = searchURL + "&" + url.Values{"cursor": {next}}.Encode()
+	}
+
+	searchTemplate.Execute(w, struct {
+		Query     string
+		Terms     []string
+		Users     []User
+		Posts     []Post
+		SearchURL string
+		NextURL   string
+		Me        User
+	}{q, terms, users, posts, searchURL, nextURL, me})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMemorySearcher(bodies ...string) *memorySearcher {
+	s := newMemorySearcher()
+	base := time.Unix(1500000000, 0)
+	for i, body := range bodies {
+		// 投稿 1 が最も古い。3 と 4 は同じ時刻にして、id で順序が決まることを確かめる
+		createdAt := base.Add(time.Duration(i) * time.Minute)
+		if i == 3 {
+			createdAt = base.Add(2 * time.Minute)
+		}
+		s.handle(postCreated{Post: Post{ID: i + 1, UserID: 1, Body: body, CreatedAt: createdAt}})
+	}
+	return s
+}
+
+func searchPostIDs(t *testing.T, s Searcher, q string, pg postsPage) []int {
+	posts, err := s.SearchPosts(parseSearchQuery(q), pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestMemorySearcherSearchPosts(t *testing.T) {
+	s := newTestMemorySearcher(
+		"猫が好き",
+		"犬が好き",
+		"猫と犬",
+		"Cats and dogs",
+		"ねこ",
+	)
+	s.handle(commentCreated{Comment: Comment{ID: 1, PostID: 5, Comment: "うちの猫です"}})
+
+	pg := postsPage{Limit: postsPerPage}
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{"好き", []int{2, 1}},
+		// すべての語を含むものだけ
+		{"猫 犬", []int{3}},
+		{"猫 好き", []int{1}},
+		{"猫 鳥", []int{}},
+		// 1文字の語は bigram の索引に無いので、長い語の途中でも見つける
+		{"猫", []int{5, 3, 1}},
+		{"猫 と", []int{3}},
+		// 大文字小文字を区別しない
+		{"CATS", []int{4}},
+		{"dog", []int{4}},
+		// コメントも対象
+		{"うちの", []int{5}},
+	}
+	for _, tt := range tests {
+		if got := searchPostIDs(t, s, tt.q, pg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchPosts(%q) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	s.handle(postHidden{PostID: 3})
+	if got := searchPostIDs(t, s, "猫", pg); !reflect.DeepEqual(got, []int{5, 1}) {
+		t.Errorf("after hiding post 3: SearchPosts(猫) = %v, want [5 1]", got)
+	}
+	s.handle(commentDeleted{PostID: 5, CommentID: 1})
+	if got := searchPostIDs(t, s, "うちの", pg); len(got) != 0 {
+		t.Errorf("after deleting the comment: SearchPosts(うちの) = %v, want []", got)
+	}
+}
+
+func TestMemorySearcherCursor(t *testing.T) {
+	s := newTestMemorySearcher("a写真1", "a写真2", "a写真3", "a写真4", "a写真5", "a写真6", "a写真7")
+
+	pg := postsPage{Limit: 3}
+	pages := [][]int{}
+	for {
+		posts, err := s.SearchPosts(parseSearchQuery("写真"), pg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, p := range posts {
+			ids = append(ids, p.ID)
+		}
+		pages = append(pages, ids)
+		next := nextCursor(posts, pg)
+		if next == "" {
+			break
+		}
+		c, err := parsePostCursor(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg.Cursor = &c
+	}
+	// 4 と 3 は同じ時刻なので id の大きい 4 が先
+	want := [][]int{{7, 6, 5}, {4, 3, 2}, {1}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	maxCreatedAt := time.Unix(1500000000, 0).Add(2 * time.Minute)
+	if got := searchPostIDs(t, s, "写真", postsPage{MaxCreatedAt: &maxCreatedAt, Limit: 10}); !reflect.DeepEqual(got, []int{4, 3, 2, 1}) {
+		t.Errorf("max_created_at: got %v, want [4 3 2 1]", got)
+	}
+}
+
+func TestMemorySearcherSearchUsers(t *testing.T) {
+	s := newMemorySearcher()
+	for i, name := range []string{"alice", "Alicia", "bob", "mallory"} {
+		s.handle(userRegistered{User: User{ID: i + 1, AccountName: name}})
+	}
+	s.handle(userBanned{UserIDs: []int{4}})
+
+	users, err := s.SearchUsers(parseSearchQuery("ali"), searchUsersLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.AccountName)
+	}
+	if want := []string{"Alicia", "alice"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("SearchUsers(ali) = %v, want %v", names, want)
+	}
+	if users, _ := s.SearchUsers(parseSearchQuery("mallory"), searchUsersLimit); len(users) != 0 {
+		t.Errorf("banned user was found: %v", users)
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	hl := highlightRegexp(parseSearchQuery("猫 CAT"))
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"猫が好き", "<mark>猫</mark>が好き"},
+		{"Cat と猫", "<mark>Cat</mark> と<mark>猫</mark>"},
+		{"<猫>", "&lt;<mark>猫</mark>&gt;"},
+		{"犬", "犬"},
+	}
+	for _, tt := range tests {
+		if got := string(formatBody(tt.body, hl)); got != tt.want {
+			t.Errorf("formatBody(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+
+	// タグのリンクの中でも強調する
+	got := string(formatBody("#猫 です", hl))
+	if !strings.Contains(got, "<mark>猫</mark>") || !strings.Contains(got, "href=") {
+		t.Errorf("formatBody(#猫) = %q", got)
+	}
+	if highlightRegexp(nil) != nil {
+		t.Error("highlightRegexp(nil) != nil")
+	}
+}
+
+// MySQL の全文検索とメモリの索引は同じクエリに同じ投稿を返す
+func TestSearchersAgree(t *testing.T) {
+	setupIntegration(t)
+
+	// 初期データに当たらないよう、すべてのクエリに印の語を入れる。
+	// ngram のストップワード (a や i) を含む bigram は索引に入らないので、印には使わない
+	mark := "zqxj" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	u := createTestUser(t, "searcher")
+	ids := []int{}
+	for _, body := range []string{"猫が好き", "犬が好き", "猫と犬", "ねこ"} {
+		ids = append(ids, createTestPost(t, u.ID, mark+" "+body).ID)
+	}
+	comments := []struct {
+		pid     int
+		comment string
+		hidden  bool
+	}{
+		{ids[3], "うちの猫です", false},
+		{ids[1], "鳥", true},
+	}
+	for _, c := range comments {
+		q := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
+		if c.hidden {
+			q = "INSERT INTO `comments` (`post_id`, `user_id`, `comment`, `hidden_at`) VALUES (?,?,?,NOW())"
+		}
+		if _, err := db.Exec(q, c.pid, u.ID, c.comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mem := newMemorySearcher()
+	if err := mem.load(); err != nil {
+		t.Fatal(err)
+	}
+	my := mysqlSearcher{}
+	if err := db.Get(&my.ngramTokenSize, "SELECT @@ngram_token_size"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{"好き", []int{ids[1], ids[0]}},
+		{"猫 犬", []int{ids[2]}},
+		// 1文字の語
+		{"猫", []int{ids[3], ids[2], ids[0]}},
+		{"と", []int{ids[2]}},
+		// 語ごとに本文かコメントのどちらかに含まれればよい
+		{"ねこ 猫", []int{ids[3]}},
+		{"うちの", []int{ids[3]}},
+		// 非表示のコメントは探さない
+		{"鳥", []int{}},
+	}
+	pg := postsPage{Limit: maxPostsPerPage}
+	for _, tt := range tests {
+		q := mark + " " + tt.q
+		for name, s := range map[string]Searcher{"mysql": my, "memory": mem} {
+			if got := searchPostIDs(t, s, q, pg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: SearchPosts(%q) = %v, want %v", name, tt.q, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zenazn/goji/web"
+)
+
+// 本文中の #tag を投稿時に post_tags に取り出しておき、タグごとの一覧と
+// 直近 trendingWindow に多く使われたタグの一覧に使う。
+// extractTags は Go の文字列として重複を除くので、tag はアクセントなどを区別する utf8mb4_bin で比べる
+const tagColumnDefinition = "varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL"
+
+var tagSchema = []string{
+	"CREATE TABLE IF NOT EXISTS `post_tags` (" +
+		"`tag` " + tagColumnDefinition + "," +
+		"`post_id` int NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`tag`, `post_id`)," +
+		"KEY `idx_post_id` (`post_id`)," +
+		"KEY `idx_created_at` (`created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+const (
+	maxTagLength   = 64
+	maxTagsPerPost = 10
+	trendingWindow = 24 * time.Hour
+	trendingLimit  = 10
+)
+
+// 単語の途中の # (a#b など) はタグとみなさない
+var tagRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])#([\p{L}\p{N}_]+)`)
+
+func ensureTagSchema() error {
+	for _, q := range tagSchema {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	// 既定の照合順序で作ってしまったテーブルを直す
+	return modifyColumnCollation("post_tags", "tag", "utf8mb4_bin", tagColumnDefinition)
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(tag)
+}
+
+// extractTags は本文からタグを出現順に重複なく取り出す
+func extractTags(body string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, m := range tagRegexp.FindAllStringSubmatch(body, -1) {
+		tag := normalizeTag(m[1])
+		if seen[tag] || utf8.RuneCountInString(tag) > maxTagLength {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTagsPerPost {
+			break
+		}
+	}
+	return tags
+}
+
+// setPostTags は投稿 pid のタグを body から作り直す。投稿・編集と同じトランザクションで呼ぶ
+func setPostTags(tx *sqlx.Tx, pid int, body string, createdAt time.Time) error {
+	if _, err := tx.Exec("DELETE FROM `post_tags` WHERE `post_id` = ?", pid); err != nil {
+		return err
+	}
+	for _, tag := range extractTags(body) {
+		if _, err := tx.Exec("INSERT INTO `post_tags` (`tag`, `post_id`, `created_at`) VALUES (?,?,?)", tag, pid, createdAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tagURL(tag string) string {
+	return "/tags/" + url.PathEscape(tag)
+}
+
+// formatBody は本文をエスケープし、タグとメンションをリンクにする。hl があればマッチした部分を強調する
+func formatBody(body string, hl *regexp.Regexp) template.HTML {
+	return formatText(body, true, hl)
+}
+
+// formatComment はコメントをエスケープし、メンションをリンクにする
+func formatComment(comment string, hl *regexp.Regexp) template.HTML {
+	return formatText(comment, false, hl)
+}
+
+type textLink struct {
+	start, end        int
+	href, text, class string
+}
+
+func formatText(s string, tags bool, hl *regexp.Regexp) template.HTML {
+	links := []textLink{}
+	// 各マッチの m[2]-1 が先頭の # や @ の位置
+	if tags {
+		for _, m := range tagRegexp.FindAllStringSubmatchIndex(s, -1) {
+			tag := s[m[2]:m[3]]
+			links = append(links, textLink{m[2] - 1, m[3], tagURL(normalizeTag(tag)), "#" + tag, "isu-tag"})
+		}
+	}
+	for _, m := range mentionRegexp.FindAllStringSubmatchIndex(s, -1) {
+		name := s[m[2]:m[3]]
+		links = append(links, textLink{m[2] - 1, m[3], "/@" + name, "@" + name, "isu-mention"})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	var b strings.Builder
+	last := 0
+	for _, l := range links {
+		if l.start < last {
+			continue
+		}
+		writeHighlighted(&b, s[last:l.start], hl)
+		fmt.Fprintf(&b, `<a href="%s" class="%s">`, template.HTMLEscapeString(l.href), l.class)
+		writeHighlighted(&b, l.text, hl)
+		b.WriteString("</a>")
+		last = l.end
+	}
+	writeHighlighted(&b, s[last:], hl)
+	return template.HTML(b.String())
+}
+
+func writeHighlighted(b *strings.Builder, s string, hl *regexp.Regexp) {
+	last := 0
+	if hl != nil {
+		for _, m := range hl.FindAllStringIndex(s, -1) {
+			b.WriteString(template.HTMLEscapeString(s[last:m[0]]))
+			b.WriteString("<mark>" + template.HTMLEscapeString(s[m[0]:m[1]]) + "</mark>")
+			last = m[1]
+		}
+	}
+	b.WriteString(template.HTMLEscapeString(s[last:]))
+}
+
+type tagCount struct {
+	Tag   string `db:"tag"`
+	Count int    `db:"cnt"`
+}
+
+func (t tagCount) URL() string {
+	return tagURL(t.Tag)
+}
+
+// 全ページのサイドバーで使うので、プロセス内で少しの間だけ使い回す
+var trendingTagsCache = newLRUCache(1, 30*time.Second)
+
+func getTrendingTags() ([]tagCount, error) {
+	if v, ok := trendingTagsCache.get("trending", 0); ok {
+		return v.([]tagCount), nil
+	}
+	v, err := cacheLoadGroup.Do("trendingTags", func() (interface{}, error) {
+		tags := []tagCount{}
+		err := db.Select(&tags, "SELECT t.`tag`, COUNT(*) AS `cnt` FROM `post_tags` t JOIN `posts` p ON p.`id` = t.`post_id` "+
+			"WHERE t.`created_at` >= ? AND p.`hidden_at` IS NULL AND p.`deleted_at` IS NULL GROUP BY t.`tag` ORDER BY `cnt` DESC, t.`tag` LIMIT ?",
+			time.Now().Add(-trendingWindow), trendingLimit)
+		if err != nil {
+			return nil, err
+		}
+		trendingTagsCache.set("trending", tags, 0)
+		return tags, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]tagCount), nil
+}
+
+func getTag(c web.C, w http.ResponseWriter, r *http.Request) {
+	tag := normalizeTag(c.URLParams["tag"])
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pg, pgerr := parsePostsPage(r)
+	if pgerr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, err := selectPostsPage(activeUserPostsCond+" AND `id` IN (SELECT `post_id` FROM `post_tags` WHERE `tag` = ? COLLATE utf8mb4_bin)", []interface{}{tag}, pg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	me := getSessionUser(r)
+	posts, merr := makePosts(results, me, getCSRFToken(r), false)
+	if merr != nil {
+		fmt.Println(merr)
+		return
+	}
+
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		if len(posts) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		postsTemplate.Execute(w, posts)
+		return
+	}
+
+	trending, err := getTrendingTags()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	nextURL := ""
+	if next := nextCursor(results, pg); next != "" {
+		nextURL = tagURL(tag) + "?" + url.Values{"cursor": {next}}.Encode()
+	}
+
+	tagTemplate.Execute(w, struct {
+		Tag      string
+		TagURL   string
+		Posts    []Post
+		NextURL  string
+		Trending []tagCount
+		Me       User
+	}{tag, tagURL(tag), posts, nextURL, trending, me})
+}
+
+// runReindexTags は既存の投稿すべてのタグを本文から作り直す
+func runReindexTags(args []string) {
+	fs := flag.NewFlagSet("reindex-tags", flag.ExitOnError)
+	fs.Parse(args)
+
+	db = openDB()
+	defer db.Close()
+
+	if err := ensureTagSchema(); err != nil {
+		log.Fatalf("Failed to create tag tables: %s", err.Error())
+	}
+
+	posts := []Post{}
+	if err := db.Select(&posts, "SELECT `id`, `body`, `created_at` FROM `posts`"); err != nil {
+		log.Fatalf("Failed to read posts: %s", err.Error())
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Fatalf("Failed to begin: %s", err.Error())
+	}
+	for _, p := range posts {
+		if err := setPostTags(tx, p.ID, p.Body, p.CreatedAt); err != nil {
+			tx.Rollback()
+			log.Fatalf("Failed to index tags of post %d: %s", p.ID, err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit: %s", err.Error())
+	}
+	fmt.Printf("reindexed tags of %d posts\n", len(posts))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractTags(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"#猫 と #犬", []string{"猫", "犬"}},
+		{"#Cat #cat #CAT", []string{"cat"}},
+		{"#café #cafe", []string{"café", "cafe"}},
+		{"a#b c#d", []string{}},
+		{"(#tag)", []string{"tag"}},
+		{"#" + strings.Repeat("a", maxTagLength+1) + " #ok", []string{"ok"}},
+		{strings.Repeat("#t ", 3) + "#a #b #c #d #e #f #g #h #i #j #k", []string{"t", "a", "b", "c", "d", "e", "f", "g", "h", "i"}},
+	}
+	for _, tt := range tests {
+		if got := extractTags(tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractTags(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// アクセントだけが違うタグも別のタグとして保存でき、それぞれのタグで引ける
+func TestSetPostTagsAccents(t *testing.T) {
+	setupIntegration(t)
+
+	u := createTestUser(t, "tagger")
+	p := createTestPost(t, u.ID, "#café #cafe")
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setPostTags(tx, p.ID, p.Body, time.Now()); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []string{}
+	if err = db.Select(&tags, "SELECT `tag` FROM `post_tags` WHERE `post_id` = ?", p.ID); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+	if want := []string{"cafe", "café"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %q, want %q", tags, want)
+	}
+	for _, tag := range []string{"cafe", "café"} {
+		n := 0
+		if err = db.Get(&n, "SELECT COUNT(*) FROM `post_tags` WHERE `tag` = ? COLLATE utf8mb4_bin AND `post_id` = ?", tag, p.ID); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%d rows for tag %q, want 1", n, tag)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// 投稿・コメントの入力の検証。どのハンドラからも同じ規則で正規化・検証し、
+// 失敗した場合は validationError の Message をそのままフラッシュメッセージや API のエラーに使う
+type validationError struct {
+	Field   string
+	Message string
+}
+
+func (e *validationError) Error() string {
+	return e.Message
+}
+
+const (
+	maxPostBodyLength = 1000
+	maxCommentLength  = 300
+)
+
+// normalizeText は NFC で正規化し、改行を LF に揃え、制御文字と書式文字 (双方向制御など) や
+// 不正な UTF-8 を取り除く。
+// multiline が false の場合は改行も空白にする
+func normalizeText(s string, multiline bool) string {
+	s = norm.NFC.String(s)
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			if multiline {
+				return r
+			}
+			return ' '
+		case r == '\t':
+			return ' '
+		// 絵文字の結合に使うゼロ幅接合子は残す
+		case r == '\u200d':
+			return r
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+func validateText(field, s string, multiline bool, max int, label string) (string, error) {
+	s = normalizeText(s, multiline)
+	if s == "" {
+		return "", &validationError{field, label + "を入力してください"}
+	}
+	if utf8.RuneCountInString(s) > max {
+		return "", &validationError{field, label + "が長すぎます"}
+	}
+	return s, nil
+}
+
+func validatePostBody(body string) (string, error) {
+	return validateText("body", body, true, maxPostBodyLength, "本文")
+}
+
+func validateComment(comment string) (string, error) {
+	return validateText("comment", comment, false, maxCommentLength, "コメント")
+}
+
+// validateAuthor は me が投稿やコメントをできるかどうかを検証する
+func validateAuthor(me User) error {
+	if me.DelFlg == 1 {
+		return &validationError{"user", "BAN されているため投稿できません"}
+	}
+	return nil
+}
+
+// validateCommentTarget は pid の投稿が表示されていて、投稿者が BAN されておらず、コメントする me をブロックしていないことを検証する
+func validateCommentTarget(pid int, me User) error {
+	target := struct {
+		UserID int `db:"user_id"`
+		DelFlg int `db:"del_flg"`
+	}{}
+	err := db.Get(&target, "SELECT p.`user_id`, u.`del_flg` FROM `posts` p JOIN `users` u ON u.`id` = p.`user_id` WHERE p.`id` = ? AND p.`hidden_at` IS NULL AND p.`deleted_at` IS NULL", pid)
+	if err == sql.ErrNoRows {
+		return &validationError{"post_id", "投稿が見つかりません"}
+	}
+	if err != nil {
+		return err
+	}
+	if target.DelFlg == 1 {
+		return &validationError{"post_id", "この投稿にはコメントできません"}
+	}
+	filter, err := getUserFilter(me.ID)
+	if err != nil {
+		return err
+	}
+	if filter.BlockedBy[target.UserID] {
+		return &validationError{"post_id", "この投稿にはコメントできません"}
+	}
+	return nil
+}
+
+// redirectWithNotice は検証エラーなどのメッセージをフラッシュに入れて url にリダイレクトする
+func redirectWithNotice(w http.ResponseWriter, r *http.Request, url, notice string) {
+	session := getSession(r)
+	session.Values["notice"] = notice
+	session.Save(r, w)
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
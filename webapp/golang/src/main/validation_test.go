@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		multiline bool
+		want      string
+	}{
+		{"crlf", "a\r\nb\rc\n", true, "a\nb\nc"},
+		{"crlf single line", "a\r\nb\rc", false, "a b c"},
+		{"tab", "a\tb", true, "a b"},
+		{"trim", "  a  \n", true, "a"},
+		{"control", "a\x00b\x1bc\x7f", true, "abc"},
+		{"bidi override", "abc\u202egnp.exe", true, "abcgnp.exe"},
+		{"bidi isolate", "\u2066a\u2069", true, "a"},
+		{"zero width space", "a\u200bb", true, "ab"},
+		{"bom", "\ufeffa", true, "a"},
+		{"keep zwj", "\U0001f468\u200d\U0001f469\u200d\U0001f467", true, "\U0001f468\u200d\U0001f469\u200d\U0001f467"},
+		{"invalid utf-8", "a\xffb\xc3", true, "ab"},
+		{"nfc", "cafe\u0301", true, "caf\u00e9"},
+		{"nfc hangul", "\u1100\u1161", true, "\uac00"},
+		{"only format characters", "\u200b\u202e", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeText(tt.in, tt.multiline); got != tt.want {
+				t.Errorf("normalizeText(%q, %v) = %q, want %q", tt.in, tt.multiline, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateText(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func(string) (string, error)
+		in       string
+		want     string
+		field    string
+	}{
+		{"empty body", validatePostBody, "", "", "body"},
+		{"blank body", validatePostBody, " \r\n\u200b", "", "body"},
+		{"body at limit", validatePostBody, strings.Repeat("あ", maxPostBodyLength), strings.Repeat("あ", maxPostBodyLength), ""},
+		{"body under limit", validatePostBody, strings.Repeat("あ", maxPostBodyLength-1), strings.Repeat("あ", maxPostBodyLength-1), ""},
+		{"body over limit", validatePostBody, strings.Repeat("あ", maxPostBodyLength+1), "", "body"},
+		// 制限は正規化した後の文字数で数える
+		{"body over limit before nfc", validatePostBody, strings.Repeat("e\u0301", maxPostBodyLength), strings.Repeat("\u00e9", maxPostBodyLength), ""},
+		{"empty comment", validateComment, "", "", "comment"},
+		{"comment at limit", validateComment, strings.Repeat("a", maxCommentLength), strings.Repeat("a", maxCommentLength), ""},
+		{"comment under limit", validateComment, strings.Repeat("a", maxCommentLength-1), strings.Repeat("a", maxCommentLength-1), ""},
+		{"comment over limit", validateComment, strings.Repeat("a", maxCommentLength+1), "", "comment"},
+		{"comment newline", validateComment, "a\nb", "a b", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.validate(tt.in)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+				return
+			}
+			verr, ok := err.(*validationError)
+			if !ok {
+				t.Fatalf("error = %v, want *validationError", err)
+			}
+			if verr.Field != tt.field {
+				t.Errorf("Field = %q, want %q", verr.Field, tt.field)
+			}
+		})
+	}
+}
+
+func TestParsePostsPageAPIError(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"limit=abc", "limit"},
+		{"limit=0", "limit"},
+		{"limit=-1", "limit"},
+		{"cursor=%21%21", "cursor"},
+		{"cursor=" + postCursor{}.String()[:4], "cursor"},
+		{"max_created_at=yesterday", "max_created_at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parsePostsPage(httptest.NewRequest("GET", "/api/posts?"+tt.query, nil))
+			if err == nil {
+				t.Fatal("parsePostsPage succeeded")
+			}
+			b, err := json.Marshal(newAPIError(err))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["field"] != tt.field {
+				t.Errorf("field = %q, want %q (%s)", got["field"], tt.field, b)
+			}
+			if got["error"] == "" {
+				t.Errorf("error is empty (%s)", b)
+			}
+		})
+	}
+
+	pg, err := parsePostsPage(httptest.NewRequest("GET", "/api/posts?limit=1000", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pg.Limit != maxPostsPerPage {
+		t.Errorf("Limit = %d, want %d", pg.Limit, maxPostsPerPage)
+	}
+}
@@ -4,8 +4,10 @@ $(function () {
     $('#isu-post-more').addClass('loading');
     $.ajax({
       type: 'GET',
-      url: '/posts',
-      data: {
+      url: $('#isu-post-more').attr('data-url') || '/posts',
+      data: $('.isu-post:last').attr('data-cursor') ? {
+        cursor: $('.isu-post:last').attr('data-cursor')
+      } : {
         max_created_at: $('.isu-post:last').attr('data-created-at')
       },
       dataType: 'html'